@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vrypan/snapdown/downloader"
+)
+
+var checkUpdateCmd = &cobra.Command{
+	Use:   "check-update <rocks dir>",
+	Short: "Check if a newer snapshot than the extracted one exists",
+	Long: `Compares the remote latest.json of each shard with the snapshot
+last extracted into <rocks dir> (as recorded by "snapdown extract").
+
+Exit codes:
+  0  all shards are up to date
+  1  error
+  2  a newer snapshot is available for at least one shard
+  3  at least one shard has no provenance record (never extracted by snapdown)
+
+For example:
+	snapdown check-update .rocks || snapdown dx ./snapshot .rocks`,
+	Run: checkUpdateRun,
+}
+
+func init() {
+	rootCmd.AddCommand(checkUpdateCmd)
+	checkUpdateCmd.Flags().IntSlice("shards", []int{0, 1, 2}, "List of shard indices (e.g. --shards=0,1,2)")
+	checkUpdateCmd.Flags().String("endpoint", endpointURL, "Snapshot server URL")
+	checkUpdateCmd.Flags().Bool("testnet", false, "Use the testnet")
+}
+
+func checkUpdateRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Please set the rocks dir")
+		os.Exit(exitError)
+	}
+	rocksDir := args[0]
+
+	endpoint, _ := cmd.Flags().GetString("endpoint")
+	if endpoint != "" {
+		endpointURL = endpoint
+	}
+	checkShards, _ := cmd.Flags().GetIntSlice("shards")
+	useTestnet, _ := cmd.Flags().GetBool("testnet")
+	if useTestnet {
+		downloader.Network = "TESTNET"
+	}
+
+	exitCode := exitUpToDate
+	for _, shard := range checkShards {
+		shardDir := downloader.ShardDir(rocksDir, shard)
+		local, err := downloader.ReadProvenance(shardDir)
+		if os.IsNotExist(err) || (err == nil && local.KeyBase == "") {
+			fmt.Printf("Shard %d: no snapshot provenance in %s\n", shard, shardDir)
+			if exitCode != exitUpdateAvailable {
+				exitCode = exitNoProvenance
+			}
+			continue
+		} else if err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
+
+		remote, err := downloader.ShardMetadata(endpointURL, shard)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
+
+		if remote.Timestamp <= local.Timestamp {
+			fmt.Printf("Shard %d: up to date [%s] (%s)\n", shard, local.KeyBase, formatRelativeTime(int64(local.Timestamp)))
+			continue
+		}
+		fmt.Printf("Shard %d: newer snapshot available, %s newer\n", shard, formatDuration(int64(remote.Timestamp-local.Timestamp)/1000))
+		fmt.Printf("  local:  [%s] (%s)\n", local.KeyBase, formatRelativeTime(int64(local.Timestamp)))
+		fmt.Printf("  remote: [%s] (%s)\n", remote.KeyBase, formatRelativeTime(int64(remote.Timestamp)))
+		exitCode = exitUpdateAvailable
+	}
+	os.Exit(exitCode)
+}
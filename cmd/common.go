@@ -3,3 +3,15 @@ package cmd
 var (
 	endpointURL = "https://pub-d352dd8819104a778e20d08888c5a661.r2.dev"
 )
+
+// Exit codes of check-update and ensure. These are meant to be used by
+// scripts, do not change existing values.
+const (
+	exitUpToDate        = 0
+	exitError           = 1
+	exitUpdateAvailable = 2
+	exitNoProvenance    = 3
+	exitDownloadFailed  = 4
+	exitExtractFailed   = 5
+	exitRefused         = 6
+)
@@ -2,8 +2,8 @@ package cmd
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"log"
+	"sync"
 
 	"github.com/spf13/cobra"
 
@@ -18,14 +18,24 @@ var dxCmd = &cobra.Command{
 	Short:   "Download and Extract the current snapshot",
 	Long: `This is equivalent to
   snapdown download <download dir> --no-tty && \
-  snapdown extract <download dir> <export dir> --no-tty`,
+  snapdown extract <download dir> <export dir> --no-tty
+
+With --pipeline, extraction starts as soon as the first chunk of a shard
+is downloaded, and follows the download chunk by chunk, so the total time
+gets close to the longest of the two instead of their sum.
+
+With --stream, no chunk is written to disk: chunks are downloaded in
+order, from --jobs parallel connections, into memory (up to --memory-mb
+for all shards being extracted) and fed straight to the extractor. A
+chunk that fails to download is retried --retries times before the
+extractor needs it. A stream that fails cannot be resumed: run dx again.`,
 	Run: dxRun,
 }
 
 func dxRun(cmd *cobra.Command, args []string) {
 	if len(args) != 2 {
 		fmt.Println("Please set download dir and output dir.")
-		os.Exit(1)
+		exit(1)
 	}
 
 	downloadDir := args[0]
@@ -43,9 +53,22 @@ func dxRun(cmd *cobra.Command, args []string) {
 	}
 	sizeChecks, _ := cmd.Flags().GetBool("size-checks")
 	useTestnet, _ := cmd.Flags().GetBool("testnet")
+	opts := mustExtractOptions(cmd)
+	pins, _ := cmd.Flags().GetStringSlice("snapshot")
+	pipeline, _ := cmd.Flags().GetBool("pipeline")
+	stream, _ := cmd.Flags().GetBool("stream")
+	ignoreSpace, _ := cmd.Flags().GetBool("ignore-space")
+	if pipeline && stream {
+		fmt.Println("--pipeline and --stream can not be used together.")
+		exit(1)
+	}
+	mustDeleteChunksOptions(cmd, &opts)
+	if stream && opts.deleteChunks {
+		fmt.Println("--stream does not save chunks, there are none to delete.")
+		exit(1)
+	}
 
 	progressChan := make(chan downloader.ProgressUpdate, 1000)
-	shardMetadata := make(map[int]*downloader.Metadata)
 	downloader.EndpointURL = endpointURL
 	downloader.ProgressChan = progressChan
 	downloader.CheckSizes = sizeChecks
@@ -54,29 +77,48 @@ func dxRun(cmd *cobra.Command, args []string) {
 	}
 
 	mustMkdirAll(downloadDir)
+	mustMkdirAll(outputDir)
+	mustLockDirs(downloadDir, outputDir)
+	defer releaseLocks()
 
-	metadataFilePath := filepath.Join(downloadDir, "metadata.json")
 	shards := []int{0, 1, 2}
 
 	// Load or fetch shard metadata
-	if _, err := os.Stat(metadataFilePath); err == nil {
-		// Existing metadata: resume
-		metadataData := mustReadFile(metadataFilePath)
-		mustUnmarshalMetadata(metadataData, &shardMetadata)
-
+	shardMetadata, resuming := loadOrFetchMetadata(downloadDir, shards, pins)
+	if resuming {
 		fmt.Printf("\nResuming Snapshot Download\n")
 		printShardAges(shardMetadata)
+	} else if len(pins) > 0 {
+		fmt.Printf("\nDownloading Pinned Snapshot\n")
+		printShardAges(shardMetadata)
 	} else {
-		// Fresh: fetch metadata from remote
-		shardMetadata = fetchShardMetadata(endpointURL, shards)
-		metadataJson := mustMarshalMetadata(shardMetadata)
-		mustWriteFile(metadataFilePath, metadataJson)
-
 		fmt.Printf("\nDownloading Latest Snapshot\n")
 	}
 
 	fmt.Printf("Download path: %s\n\n", downloader.OutputBasePath)
 
+	var needs []downloader.SpaceNeed
+	if !stream {
+		needs = downloadNeeds(downloadDir, shards, shardMetadata)
+	}
+	needs = append(needs, extractionNeeds(opts, downloadDir, outputDir, shards, shardMetadata)...)
+	checkSpace(needs, ignoreSpace)
+	stopWatching := watchSpace([]string{downloadDir, outputDir}, func(warning string) {
+		log.Printf("[WARN] %s\n", warning)
+	})
+	defer stopWatching()
+
+	if stream {
+		memoryMB, _ := cmd.Flags().GetInt64("memory-mb")
+		retries, _ := cmd.Flags().GetInt("retries")
+		dxStreamed(opts, downloadDir, outputDir, shards, shardMetadata, progressChan, concurrentJobs, memoryMB*1024*1024, retries)
+		return
+	}
+	if pipeline {
+		dxPipelined(opts, downloadDir, outputDir, shards, shardMetadata, progressChan, concurrentJobs)
+		return
+	}
+
 	go func() {
 		for _, shard := range shards {
 			downloader.Download(shard, shardMetadata[shard])
@@ -87,32 +129,92 @@ func dxRun(cmd *cobra.Command, args []string) {
 	nottyModel := ui.NewNoTTYDownload(shardMetadata, progressChan, concurrentJobs)
 	nottyModel.Run()
 	if len(nottyModel.Errors) > 0 {
-		os.Exit(1)
+		exit(1)
 	}
 
 	if len(args) < 2 {
 		fmt.Println("Provide input and output dirs")
-		os.Exit(1)
-	}
-
-	if !downloader.HasTarInPath() {
-		fmt.Println("Error: 'tar' not found in PATH.")
-		os.Exit(1)
+		exit(1)
 	}
 
 	// Extract
 
 	progressCh := make(chan downloader.XUpdMsg, 1000)
 	fmt.Printf("\nExtracting Snapshot [%s] -> [%s]\n\n", downloadDir, outputDir)
+	go extractShards(opts, downloadDir, outputDir, shards, progressCh)
+	var maxShard = len(shards) - 1
+	runNoTtyExtraction(maxShard, progressCh)
+
+}
+
+// dxPipelined extracts each chunk as soon as it has been downloaded, instead
+// of waiting for the whole download to finish. Download fetches chunks in
+// order, so the extractor rarely has to wait for more than one chunk.
+func dxPipelined(opts extractOptions, downloadDir, outputDir string, shards []int, shardMetadata map[int]*downloader.Metadata, progressChan chan downloader.ProgressUpdate, concurrentJobs int) {
+	tracker := downloader.NewChunkTracker()
+	downloader.ChunkDone = tracker.ChunkDone
+	opts.chunks = func(srcDir string, shard int) (downloader.ChunkSource, error) {
+		return tracker.Chunks(srcDir, shard, shardMetadata[shard]), nil
+	}
+
 	go func() {
 		for _, shard := range shards {
-			downloader.ExtractWithNativeTar(downloadDir, outputDir, shard, progressCh)
+			downloader.Download(shard, shardMetadata[shard])
 		}
-		progressCh <- downloader.XUpdMsg{Quit: true}
+		tracker.Abort(fmt.Errorf("download did not complete"))
+		progressChan <- downloader.ProgressUpdate{Quit: true}
 	}()
-	var maxShard = len(shards) - 1
-	runNoTtyExtraction(maxShard, progressCh)
 
+	fmt.Printf("Extracting Snapshot [%s] -> [%s] while downloading\n\n", downloadDir, outputDir)
+	progressCh := make(chan downloader.XUpdMsg, 1000)
+	go extractShards(opts, downloadDir, outputDir, shards, progressCh)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	downloadModel := ui.NewNoTTYDownload(shardMetadata, progressChan, concurrentJobs)
+	go func() {
+		defer wg.Done()
+		downloadModel.Run()
+	}()
+	extractModel := ui.NewNoTtyExtract(len(shards)-1, progressCh)
+	extractModel.Run()
+	wg.Wait()
+
+	if len(downloadModel.Errors) > 0 || len(extractModel.Errors) > 0 {
+		exit(1)
+	}
+}
+
+// dxStreamed downloads the chunks straight into the extractor, without
+// saving them. The memory budget is split between the shards extracted
+// at the same time.
+func dxStreamed(opts extractOptions, downloadDir, outputDir string, shards []int, shardMetadata map[int]*downloader.Metadata, progressChan chan downloader.ProgressUpdate, concurrentJobs int, budget int64, retries int) {
+	shardBudget := budget / int64(opts.parallel)
+	opts.chunks = func(srcDir string, shard int) (downloader.ChunkSource, error) {
+		return downloader.NewStreamChunks(shard, shardMetadata[shard], downloader.Concurrency, shardBudget, retries), nil
+	}
+
+	fmt.Printf("Streaming Snapshot -> [%s]\n\n", outputDir)
+	progressCh := make(chan downloader.XUpdMsg, 1000)
+	go func() {
+		extractShards(opts, downloadDir, outputDir, shards, progressCh)
+		progressChan <- downloader.ProgressUpdate{Quit: true}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	downloadModel := ui.NewNoTTYDownload(shardMetadata, progressChan, concurrentJobs)
+	go func() {
+		defer wg.Done()
+		downloadModel.Run()
+	}()
+	extractModel := ui.NewNoTtyExtract(len(shards)-1, progressCh)
+	extractModel.Run()
+	wg.Wait()
+
+	if len(downloadModel.Errors) > 0 || len(extractModel.Errors) > 0 {
+		exit(1)
+	}
 }
 
 func init() {
@@ -121,4 +223,13 @@ func init() {
 	dxCmd.Flags().String("endpoint", endpointURL, "Snapshot server URL")
 	dxCmd.Flags().Bool("size-checks", true, "If a chunk exists locally, check its size against the remote one.")
 	dxCmd.Flags().Bool("testnet", false, "Use the testnet")
+	addExtractFlags(dxCmd)
+	dxCmd.Flags().Bool("pipeline", false, "Extract chunks while the rest of the snapshot is downloading")
+	dxCmd.Flags().Bool("stream", false, "Extract chunks as they are downloaded, without writing them to disk")
+	dxCmd.Flags().Int64("memory-mb", 1024, "Memory used to buffer chunks with --stream, in MB")
+	dxCmd.Flags().Int("retries", 3, "Number of times a chunk is retried with --stream")
+	dxCmd.Flags().Bool("delete-chunks", false, "Delete the chunks of each shard once it has been extracted and verified")
+	dxCmd.Flags().Bool("delete-as-you-go", false, "Also delete chunks during the extraction, once they are no longer needed to resume it (syncs as --fsync end does, at least)")
+	dxCmd.Flags().Bool("ignore-space", false, "Report a lack of disk space or inodes, but start anyway")
+	dxCmd.Flags().StringSlice("snapshot", nil, "Download a specific snapshot instead of latest: a key base (pins its shard) or a timestamp (see: snapdown list)")
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -27,23 +28,27 @@ var downloadCmd = &cobra.Command{
 func formatRelativeTime(timestampMs int64) string {
 	t := timestampMs / 1000 // Convert ms to seconds
 	now := time.Now().Unix()
-	diff := now - t
+	return formatDuration(now-t) + " ago"
+}
+
+// formatDuration returns a short, rounded representation of a number of seconds
+func formatDuration(diff int64) string {
 	switch {
 	case diff < 60:
-		return fmt.Sprintf("%ds ago", diff)
+		return fmt.Sprintf("%ds", diff)
 	case diff < 3600:
-		return fmt.Sprintf("%dm ago", diff/60)
+		return fmt.Sprintf("%dm", diff/60)
 	case diff < 86400:
-		return fmt.Sprintf("%dh ago", diff/3600)
+		return fmt.Sprintf("%dh", diff/3600)
 	default:
-		return fmt.Sprintf("%dd ago", diff/86400)
+		return fmt.Sprintf("%dd", diff/86400)
 	}
 }
 
 func mustMkdirAll(path string) {
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		fmt.Printf("Error creating output directory: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 }
 
@@ -51,22 +56,50 @@ func mustReadFile(path string) []byte {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		fmt.Printf("Failed to read %s: %v\n", path, err)
-		os.Exit(1)
+		exit(1)
 	}
 	return data
 }
 
 func mustWriteFile(path string, data []byte) {
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	if err := downloader.ReplaceFile(path, data); err != nil {
 		fmt.Printf("Failed to write %s: %v\n", path, err)
-		os.Exit(1)
+		exit(1)
 	}
 }
 
+// addIOFlags registers the flags that say how files are written, see
+// downloader/durable.go and downloader/cache.go.
+func addIOFlags(cmd *cobra.Command) {
+	cmd.Flags().String("fsync", "never", "When to wait for written files to be on disk: never (leave it to the system), chunk (every chunk and extracted file) or end (every shard, once complete)")
+	cmd.Flags().Bool("low-cache", false, "Drop the chunks and files read and written from the page cache, to leave it to a node running on the same host (Linux)")
+	cmd.Flags().Bool("direct-io", false, "Write chunks with O_DIRECT, bypassing the page cache (Linux, implies --low-cache)")
+}
+
+// ioFromFlags reads the flags registered by addIOFlags.
+func ioFromFlags(cmd *cobra.Command) error {
+	name, _ := cmd.Flags().GetString("fsync")
+	policy, err := downloader.ParseFsyncPolicy(name)
+	if err != nil {
+		return err
+	}
+	downloader.Fsync = policy
+	downloader.LowCache, _ = cmd.Flags().GetBool("low-cache")
+	downloader.DirectIO, _ = cmd.Flags().GetBool("direct-io")
+	if downloader.DirectIO {
+		downloader.LowCache = true
+	}
+	return nil
+}
+
 func mustUnmarshalMetadata(data []byte, meta *map[int]*downloader.Metadata) {
 	if err := json.Unmarshal(data, meta); err != nil {
 		fmt.Printf("Failed to parse metadata: %v\n", err)
-		os.Exit(1)
+		exit(1)
+	}
+	if err := downloader.ValidateShardMetadata(*meta); err != nil {
+		fmt.Println(err)
+		exit(1)
 	}
 }
 
@@ -74,7 +107,7 @@ func mustMarshalMetadata(meta map[int]*downloader.Metadata) []byte {
 	data, err := json.MarshalIndent(meta, "", "  ")
 	if err != nil {
 		fmt.Printf("Failed to serialize shard metadata: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 	return data
 }
@@ -85,13 +118,105 @@ func fetchShardMetadata(endpoint string, shards []int) map[int]*downloader.Metad
 		metadata, err := downloader.ShardMetadata(endpoint, shard)
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
+		}
+		shardMetadata[shard] = metadata
+	}
+	return shardMetadata
+}
+
+// pinnedShardMetadata resolves the --snapshot selectors to shard metadata.
+// A key base pins the shard it belongs to, a timestamp pins every other shard
+// to its newest snapshot not newer than that timestamp. Shards without a
+// selector use latest.json.
+func pinnedShardMetadata(endpoint string, shards []int, pins []string) map[int]*downloader.Metadata {
+	if len(pins) == 0 {
+		return fetchShardMetadata(endpoint, shards)
+	}
+	selectors := make(map[int]string)
+	timestamp := ""
+	for _, pin := range pins {
+		if !strings.Contains(pin, "/") {
+			if timestamp != "" {
+				fmt.Printf("--snapshot: only one timestamp can be given, got %s and %s\n", timestamp, pin)
+				exit(1)
+			}
+			timestamp = pin
+			continue
+		}
+		shard, err := downloader.KeyBaseShard(pin)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		selectors[shard] = pin
+	}
+
+	shardMetadata := make(map[int]*downloader.Metadata)
+	for _, shard := range shards {
+		selector, ok := selectors[shard]
+		if !ok {
+			selector = timestamp
+		}
+		if selector == "" {
+			metadata, err := downloader.ShardMetadata(endpoint, shard)
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			shardMetadata[shard] = metadata
+			continue
+		}
+		snapshots, err := downloader.ListSnapshots(endpoint, shard)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		snapshot, err := downloader.FindSnapshot(snapshots, selector)
+		if err != nil {
+			fmt.Printf("Shard %d: %v\n", shard, err)
+			exit(1)
+		}
+		metadata := snapshot.Metadata()
+		if err := metadata.Validate(shard); err != nil {
+			fmt.Println(err)
+			exit(1)
 		}
 		shardMetadata[shard] = metadata
 	}
 	return shardMetadata
 }
 
+// loadOrFetchMetadata reads <dir>/metadata.json to resume a download, or fetches
+// fresh metadata and stores it there. It returns true when resuming.
+func loadOrFetchMetadata(dir string, shards []int, pins []string) (map[int]*downloader.Metadata, bool) {
+	metadataFilePath := filepath.Join(dir, "metadata.json")
+	shardMetadata := make(map[int]*downloader.Metadata)
+
+	if _, err := os.Stat(metadataFilePath); err == nil {
+		// Existing metadata: resume
+		metadataData := mustReadFile(metadataFilePath)
+		mustUnmarshalMetadata(metadataData, &shardMetadata)
+		if len(pins) > 0 {
+			pinned := pinnedShardMetadata(endpointURL, shards, pins)
+			for _, shard := range shards {
+				if shardMetadata[shard] == nil || shardMetadata[shard].KeyBase != pinned[shard].KeyBase {
+					fmt.Printf("%s belongs to a different snapshot than %s.\n", metadataFilePath, pinned[shard].KeyBase)
+					fmt.Println("Use an empty download dir, or remove metadata.json to start over.")
+					exit(1)
+				}
+			}
+		}
+		return shardMetadata, true
+	}
+
+	// Fresh: fetch metadata from remote
+	shardMetadata = pinnedShardMetadata(endpointURL, shards, pins)
+	metadataJson := mustMarshalMetadata(shardMetadata)
+	mustWriteFile(metadataFilePath, metadataJson)
+	return shardMetadata, false
+}
+
 func printShardAges(shardMetadata map[int]*downloader.Metadata) {
 	fmt.Printf("Snapshot Ages per shard: ")
 	for _, s := range shardMetadata {
@@ -103,7 +228,7 @@ func printShardAges(shardMetadata map[int]*downloader.Metadata) {
 func downloadRun(cmd *cobra.Command, args []string) {
 	if len(args) != 1 {
 		fmt.Println("Please set the output dir")
-		os.Exit(1)
+		exit(1)
 	}
 	outputDir := args[0]
 	downloader.OutputBasePath = outputDir
@@ -120,9 +245,14 @@ func downloadRun(cmd *cobra.Command, args []string) {
 	sizeChecks, _ := cmd.Flags().GetBool("size-checks")
 	useTestnet, _ := cmd.Flags().GetBool("testnet")
 	notty, _ := cmd.Flags().GetBool("no-tty")
+	pins, _ := cmd.Flags().GetStringSlice("snapshot")
+	ignoreSpace, _ := cmd.Flags().GetBool("ignore-space")
+	if err := ioFromFlags(cmd); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		exit(1)
+	}
 
 	progressChan := make(chan downloader.ProgressUpdate, 1000)
-	shardMetadata := make(map[int]*downloader.Metadata)
 	downloader.EndpointURL = endpointURL
 	downloader.ProgressChan = progressChan
 	downloader.CheckSizes = sizeChecks
@@ -131,29 +261,34 @@ func downloadRun(cmd *cobra.Command, args []string) {
 	}
 
 	mustMkdirAll(outputDir)
+	mustLockDirs(outputDir)
+	defer releaseLocks()
 
-	metadataFilePath := filepath.Join(outputDir, "metadata.json")
 	shards := []int{0, 1, 2}
 
 	// Load or fetch shard metadata
-	if _, err := os.Stat(metadataFilePath); err == nil {
-		// Existing metadata: resume
-		metadataData := mustReadFile(metadataFilePath)
-		mustUnmarshalMetadata(metadataData, &shardMetadata)
-
+	shardMetadata, resuming := loadOrFetchMetadata(outputDir, shards, pins)
+	if resuming {
 		fmt.Printf("\nResuming Snapshot Download\n")
 		printShardAges(shardMetadata)
+	} else if len(pins) > 0 {
+		fmt.Printf("\nDownloading Pinned Snapshot\n")
+		printShardAges(shardMetadata)
 	} else {
-		// Fresh: fetch metadata from remote
-		shardMetadata = fetchShardMetadata(endpointURL, shards)
-		metadataJson := mustMarshalMetadata(shardMetadata)
-		mustWriteFile(metadataFilePath, metadataJson)
-
 		fmt.Printf("\nDownloading Latest Snapshot\n")
 	}
 
 	fmt.Printf("Download path: %s\n\n", downloader.OutputBasePath)
 
+	checkSpace(downloadNeeds(outputDir, shards, shardMetadata), ignoreSpace)
+	stopWatching := watchSpace([]string{outputDir}, func(warning string) {
+		select {
+		case progressChan <- downloader.ProgressUpdate{Warning: warning}:
+		default:
+		}
+	})
+	defer stopWatching()
+
 	go func() {
 		for _, shard := range shards {
 			downloader.Download(shard, shardMetadata[shard])
@@ -166,7 +301,7 @@ func downloadRun(cmd *cobra.Command, args []string) {
 		nottyModel := ui.NewNoTTYDownload(shardMetadata, progressChan, concurrentJobs)
 		nottyModel.Run()
 		if len(nottyModel.Errors) > 0 {
-			os.Exit(1)
+			exit(1)
 		}
 	} else {
 		// Use fancy bubbletea interfcae
@@ -189,7 +324,7 @@ func downloadRun(cmd *cobra.Command, args []string) {
 			for _, e := range downloadModel.Errors {
 				fmt.Println(e)
 			}
-			os.Exit(1)
+			exit(1)
 		}
 	}
 }
@@ -201,4 +336,7 @@ func init() {
 	downloadCmd.Flags().Bool("size-checks", true, "If a chunk exists locally, check its size against the remote one.")
 	downloadCmd.Flags().Bool("testnet", false, "Use the testnet")
 	downloadCmd.Flags().Bool("no-tty", false, "Plan text output")
+	downloadCmd.Flags().Bool("ignore-space", false, "Report a lack of disk space or inodes, but start anyway")
+	addIOFlags(downloadCmd)
+	downloadCmd.Flags().StringSlice("snapshot", nil, "Download a specific snapshot instead of latest: a key base (pins its shard) or a timestamp (see: snapdown list)")
 }
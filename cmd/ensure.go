@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vrypan/snapdown/downloader"
+	"github.com/vrypan/snapdown/ui"
+)
+
+var ensureCmd = &cobra.Command{
+	Use:   "ensure <work dir> <rocks dir>",
+	Short: "Make sure <rocks dir> holds a recent snapshot (idempotent)",
+	Long: `Does nothing if every shard in <rocks dir> was extracted from the latest
+snapshot (or, with --max-age, from a snapshot younger than that).
+Otherwise it downloads the latest snapshot to <work dir>, verifies it,
+extracts the shards that need it, and removes the downloaded chunks.
+
+It is safe to run again after a failure or a restart: finished chunks
+and already extracted shards are not processed twice.
+
+Output is plain text, and the last line is always a machine-readable status:
+	snapdown-ensure status=<up-to-date|updated|error|refused> ...
+
+Exit codes:
+  0  <rocks dir> is up to date (already, or after updating it)
+  1  error
+  4  download failed
+  5  extraction failed
+  6  refused to overwrite data of unknown origin (--strict), or another
+     snapdown run is using <work dir> or <rocks dir>`,
+	Run: ensureRun,
+}
+
+func init() {
+	rootCmd.AddCommand(ensureCmd)
+	ensureCmd.Flags().IntP("jobs", "j", 5, "Number of concurrent downloads.")
+	ensureCmd.Flags().String("endpoint", endpointURL, "Snapshot server URL")
+	ensureCmd.Flags().Bool("testnet", false, "Use the testnet")
+	ensureCmd.Flags().IntSlice("shards", []int{0, 1, 2}, "List of shard indices (e.g. --shards=0,1,2)")
+	ensureCmd.Flags().Duration("max-age", 0, "Accept an extracted snapshot younger than this (e.g. 48h) without checking for a newer one. 0 = must be the latest.")
+	ensureCmd.Flags().Bool("strict", false, "Refuse to overwrite shards that were not extracted by snapdown, and to use a work dir holding another snapshot")
+	ensureCmd.Flags().Bool("keep-chunks", false, "Do not delete downloaded chunks after a successful extraction")
+	addExtractFlags(ensureCmd)
+	ensureCmd.Flags().BoolP("quiet", "q", false, "Only print the final status line")
+}
+
+// ensureStatus prints the final status line and exits.
+func ensureStatus(code int, status string, fields ...string) {
+	line := "snapdown-ensure status=" + status
+	if len(fields) > 0 {
+		line += " " + strings.Join(fields, " ")
+	}
+	fmt.Println(line)
+	exit(code)
+}
+
+func ensureRun(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		ensureStatus(exitError, "error", `reason="please set work dir and rocks dir"`)
+	}
+	workDir := args[0]
+	rocksDir := args[1]
+
+	concurrentJobs, _ := cmd.Flags().GetInt("jobs")
+	if concurrentJobs != 0 {
+		downloader.Concurrency = concurrentJobs
+	}
+	endpoint, _ := cmd.Flags().GetString("endpoint")
+	if endpoint != "" {
+		endpointURL = endpoint
+	}
+	useTestnet, _ := cmd.Flags().GetBool("testnet")
+	ensureShards, _ := cmd.Flags().GetIntSlice("shards")
+	maxAge, _ := cmd.Flags().GetDuration("max-age")
+	strict, _ := cmd.Flags().GetBool("strict")
+	keepChunks, _ := cmd.Flags().GetBool("keep-chunks")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	opts, err := extractOptionsFromFlags(cmd)
+	if err != nil {
+		ensureStatus(exitError, "error", fmt.Sprintf("reason=%q", err.Error()))
+	}
+
+	downloader.EndpointURL = endpointURL
+	downloader.OutputBasePath = workDir
+	if useTestnet {
+		downloader.Network = "TESTNET"
+	}
+	if quiet {
+		log.SetOutput(io.Discard)
+	}
+	logf := func(format string, a ...any) {
+		if !quiet {
+			fmt.Printf(format, a...)
+		}
+	}
+	start := time.Now()
+
+	for _, dir := range []string{workDir, rocksDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			ensureStatus(exitError, "error", fmt.Sprintf("reason=%q", err.Error()))
+		}
+	}
+	if err := lockDirs(workDir, rocksDir); err != nil {
+		var locked *downloader.LockedError
+		if errors.As(err, &locked) {
+			ensureStatus(exitRefused, "refused", fmt.Sprintf("reason=%q", err.Error()))
+		}
+		ensureStatus(exitError, "error", fmt.Sprintf("reason=%q", err.Error()))
+	}
+
+	// 1. What do we have?
+	local := make(map[int]*downloader.Provenance)
+	for _, shard := range ensureShards {
+		shardDir := downloader.ShardDir(rocksDir, shard)
+		p, err := downloader.ReadProvenance(shardDir)
+		if err == nil && p.KeyBase != "" {
+			local[shard] = p
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			ensureStatus(exitError, "error", fmt.Sprintf("shard=%d", shard), fmt.Sprintf("reason=%q", err.Error()))
+		}
+		if strict && !isEmptyDir(shardDir) {
+			ensureStatus(exitRefused, "refused", fmt.Sprintf("shard=%d", shard),
+				fmt.Sprintf("reason=%q", shardDir+" holds data that was not extracted by snapdown"))
+		}
+	}
+
+	if maxAge > 0 && len(local) == len(ensureShards) {
+		fresh := true
+		for _, p := range local {
+			if time.Since(time.UnixMilli(int64(p.Timestamp))) > maxAge {
+				fresh = false
+			}
+		}
+		if fresh {
+			ensureStatus(exitUpToDate, "up-to-date", ensureFields(ensureShards, local, start)...)
+		}
+	}
+
+	// 2. What is available?
+	remote := make(map[int]*downloader.Metadata)
+	for _, shard := range ensureShards {
+		metadata, err := downloader.ShardMetadata(endpointURL, shard)
+		if err != nil {
+			ensureStatus(exitError, "error", fmt.Sprintf("shard=%d", shard), fmt.Sprintf("reason=%q", strings.TrimSpace(err.Error())))
+		}
+		remote[shard] = metadata
+	}
+
+	var pending []int
+	for _, shard := range ensureShards {
+		p := local[shard]
+		if p == nil || p.Timestamp < remote[shard].Timestamp {
+			pending = append(pending, shard)
+		}
+	}
+	if len(pending) == 0 {
+		ensureStatus(exitUpToDate, "up-to-date", ensureFields(ensureShards, local, start)...)
+	}
+
+	// 3. Download. Resume if the work dir holds the same snapshot, start over otherwise.
+	metadataFilePath := filepath.Join(workDir, "metadata.json")
+	previous, err := downloader.ReadLocalMetadata(workDir)
+	if err != nil {
+		// Not on stdout, which only holds the progress and the status line
+		fmt.Fprintf(os.Stderr, "Warning: ignoring %v\n", err)
+	}
+	for _, shard := range pending {
+		if previous[shard] == nil || previous[shard].KeyBase == remote[shard].KeyBase {
+			continue
+		}
+		if strict {
+			ensureStatus(exitRefused, "refused", fmt.Sprintf("shard=%d", shard),
+				fmt.Sprintf("reason=%q", workDir+" holds chunks of another snapshot"))
+		}
+		logf("Removing chunks of %s\n", previous[shard].KeyBase)
+		if err := downloader.DeleteChunks(workDir, shard); err != nil {
+			ensureStatus(exitError, "error", fmt.Sprintf("reason=%q", err.Error()))
+		}
+	}
+	data, err := json.MarshalIndent(remote, "", "  ")
+	if err == nil {
+		err = downloader.ReplaceFile(metadataFilePath, data)
+	}
+	if err != nil {
+		ensureStatus(exitError, "error", fmt.Sprintf("reason=%q", "writing metadata.json: "+err.Error()))
+	}
+
+	logf("\nDownloading Snapshot to %s\n", workDir)
+	progressChan := make(chan downloader.ProgressUpdate, 1000)
+	downloader.ProgressChan = progressChan
+	go func() {
+		for _, shard := range pending {
+			downloader.Download(shard, remote[shard])
+		}
+		progressChan <- downloader.ProgressUpdate{Quit: true}
+	}()
+	downloadModel := ui.NewNoTTYDownload(remote, progressChan, concurrentJobs)
+	downloadModel.Run()
+	if len(downloadModel.Errors) > 0 {
+		ensureStatus(exitDownloadFailed, "error", fmt.Sprintf("reason=%q", downloadModel.Errors[0].Error()))
+	}
+
+	// 4. Verify
+	for _, shard := range pending {
+		if err := downloader.VerifyChunks(workDir, shard, remote[shard]); err != nil {
+			ensureStatus(exitDownloadFailed, "error", fmt.Sprintf("shard=%d", shard), fmt.Sprintf("reason=%q", err.Error()))
+		}
+	}
+
+	// 5. Extract
+	logf("\nExtracting Snapshot [%s] -> [%s]\n\n", workDir, rocksDir)
+	progressCh := make(chan downloader.XUpdMsg, 1000)
+	go extractShards(opts, workDir, rocksDir, pending, progressCh)
+	extractModel := ui.NewNoTtyExtract(ensureShards[len(ensureShards)-1], progressCh)
+	extractModel.Run()
+	if len(extractModel.Errors) > 0 {
+		ensureStatus(exitExtractFailed, "error", fmt.Sprintf("reason=%q", extractModel.Errors[0].Error()))
+	}
+	for _, shard := range pending {
+		p, err := downloader.ReadProvenance(downloader.ShardDir(rocksDir, shard))
+		if err != nil || p.KeyBase != remote[shard].KeyBase {
+			ensureStatus(exitExtractFailed, "error", fmt.Sprintf("shard=%d", shard), `reason="extraction did not complete"`)
+		}
+		local[shard] = p
+	}
+
+	// 6. Clean up
+	if !keepChunks {
+		for _, shard := range pending {
+			downloader.DeleteChunks(workDir, shard)
+		}
+		os.Remove(metadataFilePath)
+	}
+
+	ensureStatus(exitUpToDate, "updated", ensureFields(ensureShards, local, start)...)
+}
+
+// ensureFields returns the key=value pairs describing the extracted snapshots
+func ensureFields(shards []int, local map[int]*downloader.Provenance, start time.Time) []string {
+	var ids, keyBases []string
+	for _, shard := range shards {
+		ids = append(ids, fmt.Sprint(shard))
+		keyBases = append(keyBases, local[shard].KeyBase)
+	}
+	return []string{
+		"shards=" + strings.Join(ids, ","),
+		"key_bases=" + strings.Join(keyBases, ","),
+		fmt.Sprintf("elapsed=%s", time.Since(start).Round(time.Second)),
+	}
+}
+
+func isEmptyDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err != nil || len(entries) == 0
+}
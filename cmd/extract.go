@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/spf13/cobra"
@@ -22,7 +26,15 @@ want to run:
 		snapdown extract ./snapshot .rocks
 to extract the files in .rocks. Then you can start your node.
 
-WARNING! Files in <destination dir> will be overwritten!
+Each shard is extracted in <output dir>/.shard-<id>.staging, and
+replaces <output dir>/shard-<id> only once the extraction succeeded,
+so a failed extraction leaves the previous database untouched. Use
+--keep-previous to keep the replaced directory, or --in-place to
+extract over it (WARNING! files are then overwritten).
+
+If the extraction of a gzip archive by the "go" decompressor is
+interrupted, running the same command again resumes it from the
+last checkpoint saved in the staging directory.
 	`,
 	Run: extractRun,
 }
@@ -31,33 +43,151 @@ func init() {
 	rootCmd.AddCommand(extractCmd)
 	extractCmd.Flags().IntSliceVar(&shards, "shards", []int{0, 1, 2}, "List of shard indices (e.g. --shard=0,1,2)")
 	extractCmd.Flags().Bool("no-tty", false, "Plain text output")
+	extractCmd.Flags().Bool("clean", false, "With --in-place, once a shard is extracted, remove the files of its directory that are not in the snapshot")
+	extractCmd.Flags().Bool("dry-run", false, "With --clean, list the files that would be removed, without extracting (the index of the shard is built first if there is none, which decompresses the whole shard)")
+	extractCmd.Flags().String("trash", "", "With --clean, move the files to this directory instead of removing them")
+	extractCmd.Flags().Bool("delete-chunks", false, "Delete the chunks of each shard once it has been extracted and verified")
+	extractCmd.Flags().Bool("delete-as-you-go", false, "Also delete chunks during the extraction, once they are no longer needed to resume it (syncs as --fsync end does, at least)")
+	extractCmd.Flags().Bool("ignore-space", false, "Report a lack of disk space or inodes, but start anyway")
+	addExtractFlags(extractCmd)
+}
+
+// extractOptions are the extraction settings shared by extract, dx and ensure.
+type extractOptions struct {
+	extractor downloader.Extractor
+	parallel  int
+	// chunks returns the chunks of a shard, downloader.DirChunks by default.
+	chunks func(srcDir string, shard int) (downloader.ChunkSource, error)
+	// inPlace extracts over the shard directory, instead of swapping
+	// a staging directory into place.
+	inPlace      bool
+	keepPrevious bool
+	// force skips checking that the shard's database is not in use.
+	force bool
+	// clean removes the files of the shard directory that are not in
+	// the archive, or moves them to trashDir if it is set.
+	clean    bool
+	trashDir string
+	// deleteChunks removes the chunks of a shard once it is extracted.
+	deleteChunks bool
+}
+
+func addExtractFlags(cmd *cobra.Command) {
+	cmd.Flags().String("extractor", "auto", "Extraction backend: auto, tar or native (auto uses tar if found in PATH)")
+	cmd.Flags().String("decompressor", "auto", "Decompressor: auto, go, gzip, pigz, igzip, zstd or none (auto detects the archive format and uses the fastest one installed)")
+	cmd.Flags().Int("parallel", 1, "Number of shards to extract at the same time")
+	cmd.Flags().Bool("in-place", false, "Extract over the existing shard directories, instead of replacing them once the extraction succeeded (needs less disk space)")
+	cmd.Flags().Bool("keep-previous", false, "Keep the replaced shard directories as <output dir>/shard-<id>.previous")
+	cmd.Flags().Bool("force", false, "Extract even if a process holds the database open (this corrupts the database of a running node)")
+	cmd.Flags().Bool("allow-outside-shard", false, "Accept archive entries outside shard-<id>/ (they still can not escape the output dir, needs --in-place)")
+	cmd.Flags().String("tar-path", "", "Path of the tar binary (default: tar in PATH)")
+	cmd.Flags().String("tar-args", "", "Extra arguments for tar, split on spaces (quotes are not interpreted), e.g. --tar-args=\"--checkpoint=1000\"")
+	addIOFlags(cmd)
+}
+
+// extractOptionsFromFlags reads the flags registered by addExtractFlags.
+func extractOptionsFromFlags(cmd *cobra.Command) (extractOptions, error) {
+	var opts extractOptions
+	name, _ := cmd.Flags().GetString("extractor")
+	decompressor, _ := cmd.Flags().GetString("decompressor")
+	tarPath, _ := cmd.Flags().GetString("tar-path")
+	tarArgs, _ := cmd.Flags().GetString("tar-args")
+	tarOpts := downloader.TarOptions{Path: tarPath, Args: strings.Fields(tarArgs)}
+	extractor, err := downloader.NewExtractor(name, decompressor, tarOpts)
+	if err != nil {
+		return opts, err
+	}
+	opts.extractor = extractor
+	if err := ioFromFlags(cmd); err != nil {
+		return opts, err
+	}
+	allowOutside, _ := cmd.Flags().GetBool("allow-outside-shard")
+	downloader.ShardRootOnly = !allowOutside
+	opts.chunks = downloader.DirChunks
+	opts.inPlace, _ = cmd.Flags().GetBool("in-place")
+	opts.keepPrevious, _ = cmd.Flags().GetBool("keep-previous")
+	if allowOutside && !opts.inPlace {
+		// Only shard-<id>/ is swapped into place, the rest of the staging
+		// directory is removed.
+		return opts, fmt.Errorf("--allow-outside-shard needs --in-place: entries outside shard-<id>/ would be lost with the staging directory")
+	}
+	opts.force, _ = cmd.Flags().GetBool("force")
+	opts.parallel, _ = cmd.Flags().GetInt("parallel")
+	if opts.parallel < 1 {
+		opts.parallel = 1
+	}
+	return opts, nil
+}
+
+func mustExtractOptions(cmd *cobra.Command) extractOptions {
+	opts, err := extractOptionsFromFlags(cmd)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		exit(1)
+	}
+	return opts
 }
 
 func extractRun(cmd *cobra.Command, args []string) {
 	if len(args) < 2 {
 		fmt.Println("Provide input and output dirs")
-		os.Exit(1)
+		exit(1)
 	}
 
-	if !downloader.HasTarInPath() {
-		fmt.Println("Error: 'tar' not found in PATH.")
-		os.Exit(1)
-	}
+	opts := mustExtractOptions(cmd)
 
 	srcDir := args[0]
 	dstDir := args[1]
 
+	opts.clean, _ = cmd.Flags().GetBool("clean")
+	opts.trashDir, _ = cmd.Flags().GetString("trash")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	if (dryRun || opts.trashDir != "") && !opts.clean {
+		fmt.Println("--dry-run and --trash can only be used with --clean")
+		exit(1)
+	}
+	if opts.clean && !opts.inPlace {
+		// A staged extraction replaces the whole shard directory: no file
+		// of the previous snapshot is left.
+		fmt.Println("--clean can only be used with --in-place")
+		exit(1)
+	}
+	if dryRun {
+		cleanDryRun(srcDir, dstDir, shards, opts.trashDir)
+		return
+	}
+	mustDeleteChunksOptions(cmd, &opts)
+
+	mustMkdirAll(dstDir)
+	mustLockDirs(dstDir)
+	defer releaseLocks()
+	// The chunks are only read, a source that can not be locked (on a
+	// read-only file system for example) is fine unless it is in use.
+	if err := lockDirs(srcDir); err != nil {
+		var locked *downloader.LockedError
+		if errors.As(err, &locked) {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+	}
+
+	ignoreSpace, _ := cmd.Flags().GetBool("ignore-space")
+	shardMetadata, _ := downloader.ReadLocalMetadata(srcDir)
+	checkSpace(extractionNeeds(opts, srcDir, dstDir, shards, shardMetadata), ignoreSpace)
+
 	progressCh := make(chan downloader.XUpdMsg, 1000)
 	notty, _ := cmd.Flags().GetBool("no-tty")
+	stopWatching := watchSpace([]string{dstDir}, func(warning string) {
+		select {
+		case progressCh <- downloader.XUpdMsg{Shard: -1, Warning: warning}:
+		default:
+		}
+	})
+	defer stopWatching()
 
 	fmt.Printf("\nExtracting Snapshot [%s] -> [%s]\n\n", srcDir, dstDir)
 
-	go func() {
-		for _, shard := range shards {
-			downloader.ExtractWithNativeTar(srcDir, dstDir, shard, progressCh)
-		}
-		progressCh <- downloader.XUpdMsg{Quit: true}
-	}()
+	go extractShards(opts, srcDir, dstDir, shards, progressCh)
 
 	const maxShard = 2
 
@@ -68,11 +198,235 @@ func extractRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// extractShards extracts the given shards, up to opts.parallel at a time,
+// and records which snapshot each of them came from. No new shard is
+// started after a failure.
+func extractShards(opts extractOptions, srcDir, dstDir string, shards []int, progressCh chan downloader.XUpdMsg) {
+	shardMetadata, err := downloader.ReadLocalMetadata(srcDir)
+	if err != nil {
+		// Without it, provenance does not tell which snapshot a shard came from
+		progressCh <- downloader.XUpdMsg{Shard: -1, Warning: fmt.Sprintf("ignoring %v", err)}
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex // protects failed, and the provenance summary in dstDir
+		failed bool
+	)
+	sem := make(chan struct{}, opts.parallel)
+	for _, shard := range shards {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			break
+		}
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result, err := extractShard(opts, srcDir, dstDir, shard, progressCh)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = true
+				return
+			}
+			provenance := downloader.NewProvenance(shardMetadata[shard], result, Version)
+			if err := downloader.RecordProvenance(dstDir, shard, provenance); err != nil {
+				progressCh <- downloader.XUpdMsg{Shard: shard, Error: err}
+			}
+			progressCh <- downloader.XUpdMsg{Shard: shard, Done: true}
+		}(shard)
+	}
+	wg.Wait()
+	progressCh <- downloader.XUpdMsg{Quit: true}
+}
+
+// extractShard extracts a shard, then removes the files of its directory
+// that are not in the archive if opts.clean is set, and its chunks if
+// opts.deleteChunks is set.
+func extractShard(opts extractOptions, srcDir, dstDir string, shard int, progressCh chan downloader.XUpdMsg) (downloader.ExtractResult, error) {
+	result, err := extractShardDir(opts, srcDir, dstDir, shard, progressCh)
+	if err != nil {
+		return result, err
+	}
+	if opts.clean {
+		if err := cleanShard(opts, dstDir, shard, result, progressCh); err != nil {
+			return result, err
+		}
+	}
+	if opts.deleteChunks {
+		deleteChunks(opts, srcDir, dstDir, shard, progressCh)
+	}
+	return result, nil
+}
+
+func cleanShard(opts extractOptions, dstDir string, shard int, result downloader.ExtractResult, progressCh chan downloader.XUpdMsg) error {
+	stale, err := downloader.StaleFiles(dstDir, shard, result.Entries)
+	if err == nil {
+		err = downloader.RemoveStale(dstDir, stale, opts.trashDir)
+	}
+	if err != nil {
+		progressCh <- downloader.XUpdMsg{Shard: shard, Error: err, Quit: true}
+		return err
+	}
+	if len(stale) > 0 {
+		progressCh <- downloader.XUpdMsg{Shard: shard, Info: fmt.Sprintf("removed %d files that are not in the snapshot", len(stale))}
+	}
+	return nil
+}
+
+// deleteChunks removes the chunks of a shard that has been extracted.
+// A shard extracted in place has not been verified yet: its chunks are
+// kept if it is not a database that can be opened.
+func deleteChunks(opts extractOptions, srcDir, dstDir string, shard int, progressCh chan downloader.XUpdMsg) {
+	if opts.inPlace {
+		if err := downloader.VerifyShard(downloader.ShardDir(dstDir, shard)); err != nil {
+			progressCh <- downloader.XUpdMsg{Shard: shard, Warning: fmt.Sprintf("keeping the chunks: %v", err)}
+			return
+		}
+	}
+	if err := downloader.DeleteChunks(srcDir, shard); err != nil {
+		progressCh <- downloader.XUpdMsg{Shard: shard, Warning: fmt.Sprintf("could not delete the chunks: %v", err)}
+		return
+	}
+	progressCh <- downloader.XUpdMsg{Shard: shard, Info: fmt.Sprintf("deleted the chunks in %s", filepath.Join(srcDir, fmt.Sprintf("shard-%d", shard)))}
+}
+
+// extractShardDir extracts a shard in its staging directory, and swaps it
+// into place once it is complete (see downloader/staging.go), unless
+// opts.inPlace is set.
+func extractShardDir(opts extractOptions, srcDir, dstDir string, shard int, progressCh chan downloader.XUpdMsg) (downloader.ExtractResult, error) {
+	fail := func(err error) (downloader.ExtractResult, error) {
+		progressCh <- downloader.XUpdMsg{Shard: shard, Error: err, Quit: true}
+		return downloader.ExtractResult{}, err
+	}
+	src, err := opts.chunks(srcDir, shard)
+	if err != nil {
+		return fail(err)
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	if err := checkNotInUse(opts, dstDir, shard); err != nil {
+		return fail(err)
+	}
+	if opts.inPlace {
+		// The shard is not the snapshot its provenance says anymore, until
+		// the extraction completes and is on disk.
+		if err := downloader.ClearProvenance(dstDir, shard); err != nil {
+			return fail(err)
+		}
+		result, err := opts.extractor.Extract(src, dstDir, shard, progressCh)
+		if err != nil {
+			return result, err
+		}
+		syncingInfo(shard, progressCh)
+		if err := downloader.SyncTree(downloader.ShardDir(dstDir, shard)); err != nil {
+			_, err = fail(err)
+			return result, err
+		}
+		return result, nil
+	}
+
+	recovered, err := downloader.PrepareStaging(dstDir, shard)
+	if err != nil {
+		return fail(err)
+	}
+	if recovered {
+		progressCh <- downloader.XUpdMsg{Shard: shard, Info: fmt.Sprintf("finished the swap interrupted by the previous run, the replaced directory is %s", downloader.PreviousDir(dstDir, shard))}
+	}
+	result, err := opts.extractor.Extract(src, downloader.StagingDir(dstDir, shard), shard, progressCh)
+	if err != nil {
+		return result, err
+	}
+	// The node may have been started during the extraction
+	if err := checkNotInUse(opts, dstDir, shard); err != nil {
+		_, err = fail(err)
+		return result, err
+	}
+	syncingInfo(shard, progressCh)
+	if err := downloader.SwapShard(dstDir, shard, opts.keepPrevious); err != nil {
+		_, err = fail(err)
+		return result, err
+	}
+	return result, nil
+}
+
+// syncingInfo tells that the files of a shard are being synced, which
+// takes a while with --fsync=end.
+func syncingInfo(shard int, progressCh chan downloader.XUpdMsg) {
+	if downloader.Fsync == downloader.FsyncEnd {
+		progressCh <- downloader.XUpdMsg{Shard: shard, Info: "syncing the extracted files to disk"}
+	}
+}
+
+// mustDeleteChunksOptions reads --delete-chunks and --delete-as-you-go,
+// which implies the former. Chunks are only deleted once the checkpoint
+// past them and the files it lists are on disk: --delete-as-you-go syncs
+// them as --fsync end does, unless --fsync chunk is given, and refuses
+// --fsync never.
+func mustDeleteChunksOptions(cmd *cobra.Command, opts *extractOptions) {
+	opts.deleteChunks, _ = cmd.Flags().GetBool("delete-chunks")
+	downloader.DeleteConsumedChunks, _ = cmd.Flags().GetBool("delete-as-you-go")
+	if !downloader.DeleteConsumedChunks {
+		return
+	}
+	opts.deleteChunks = true
+	if downloader.Fsync == downloader.FsyncNever {
+		if cmd.Flags().Changed("fsync") {
+			fmt.Println("--delete-as-you-go can not be used with --fsync never: after a power loss, the extracted files and the chunks to extract them again could both be lost")
+			exit(1)
+		}
+		downloader.Fsync = downloader.FsyncEnd
+	}
+}
+
+// checkNotInUse refuses to write to the database of a running node,
+// unless opts.force is set.
+func checkNotInUse(opts extractOptions, dstDir string, shard int) error {
+	if opts.force {
+		return nil
+	}
+	if err := downloader.DatabaseInUse(downloader.ShardDir(dstDir, shard)); err != nil {
+		return fmt.Errorf("shard %d: %v, or use --force to extract anyway", shard, err)
+	}
+	return nil
+}
+
+// cleanDryRun lists the files that extract --clean would remove, using
+// the index of each shard to know what is in the snapshot. A missing
+// index is built, by reading the whole shard.
+func cleanDryRun(srcDir, dstDir string, shards []int, trashDir string) {
+	for _, shard := range shards {
+		_, index := mustShardIndex(srcDir, shard)
+		names := make([]string, len(index.Entries))
+		for i, e := range index.Entries {
+			names[i] = e.Name
+		}
+		stale, err := downloader.StaleFiles(dstDir, shard, names)
+		if err != nil {
+			fmt.Printf("Shard %d: %v\n", shard, err)
+			exit(1)
+		}
+		for _, p := range stale {
+			if trashDir != "" {
+				rel, _ := filepath.Rel(dstDir, p)
+				fmt.Printf("Shard %d: would move %s to %s\n", shard, p, filepath.Join(trashDir, rel))
+			} else {
+				fmt.Printf("Shard %d: would remove %s\n", shard, p)
+			}
+		}
+		fmt.Printf("Shard %d: %d files not in the snapshot\n", shard, len(stale))
+	}
+}
+
 func runNoTtyExtraction(numShards int, progressCh chan downloader.XUpdMsg) {
 	model := ui.NewNoTtyExtract(numShards, progressCh)
 	model.Run()
 	if len(model.Errors) > 0 {
-		os.Exit(1)
+		exit(1)
 	}
 }
 
@@ -90,6 +444,6 @@ func runTtyExtraction(numShards int, progressCh chan downloader.XUpdMsg) {
 		for _, e := range extractModel.Errors {
 			fmt.Println(e)
 		}
-		os.Exit(1)
+		exit(1)
 	}
 }
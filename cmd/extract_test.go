@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vrypan/snapdown/downloader"
+)
+
+// writeShardArchive saves a gzip archive of shard 0 as the single chunk of
+// srcDir/shard-0. A corrupt archive has a wrong CRC, which is only found
+// once every file has been extracted.
+func writeShardArchive(t *testing.T, srcDir string, corrupt bool) {
+	t.Helper()
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	files := map[string]string{
+		"shard-0/CURRENT":         "MANIFEST-000001\n",
+		"shard-0/MANIFEST-000001": "manifest",
+		"shard-0/000001.sst":      "new data",
+	}
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	data := b.Bytes()
+	if corrupt {
+		data[len(data)-8] ^= 0xff
+	}
+	dir := filepath.Join(srcDir, "shard-0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "chunk_0000"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// extractInPlace runs extract --in-place on shard 0, and tells if it
+// succeeded.
+func extractInPlace(t *testing.T, srcDir, dstDir string) bool {
+	t.Helper()
+	opts := extractOptions{
+		extractor: downloader.NativeExtractor{Decompressor: "go"},
+		parallel:  1,
+		chunks:    downloader.DirChunks,
+		inPlace:   true,
+	}
+	progressCh := make(chan downloader.XUpdMsg, 1000)
+	go extractShards(opts, srcDir, dstDir, []int{0}, progressCh)
+	ok := true
+	for msg := range progressCh {
+		if msg.Error != nil {
+			ok = false
+		}
+		if msg.Quit && msg.Error == nil {
+			break
+		}
+	}
+	return ok
+}
+
+func TestExtractInPlaceProvenance(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeShardArchive(t, srcDir, false)
+	if !extractInPlace(t, srcDir, dstDir) {
+		t.Fatal("extraction failed")
+	}
+	if _, err := downloader.ReadProvenance(downloader.ShardDir(dstDir, 0)); err != nil {
+		t.Fatalf("no provenance after a successful extraction: %v", err)
+	}
+
+	// A failed extraction over it leaves a shard that is neither the old
+	// snapshot nor the new one.
+	writeShardArchive(t, srcDir, true)
+	if extractInPlace(t, srcDir, dstDir) {
+		t.Fatal("extraction of a corrupt archive succeeded")
+	}
+	if _, err := downloader.ReadProvenance(downloader.ShardDir(dstDir, 0)); !os.IsNotExist(err) {
+		t.Fatalf("provenance of a failed in-place extraction: got %v, expected none", err)
+	}
+	root, err := downloader.ReadProvenance(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Shards[0] != nil {
+		t.Fatal("the summary still lists the shard whose extraction failed")
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/vrypan/snapdown/downloader"
+	"github.com/vrypan/snapdown/ui"
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index <download dir>",
+	Short: "Index the downloaded chunks, to extract single files quickly",
+	Long: `Reads the archive of each shard, and saves the position of every file
+in it to <download dir>/shard-<id>.index. "snapdown get" then extracts
+single files without decompressing the whole shard.
+
+"snapdown extract" saves the index too, when the archive is decompressed
+by the "go" decompressor (or is not compressed), so you only need this
+command if the snapshot was extracted with another decompressor.`,
+	Run: indexRun,
+}
+
+var getCmd = &cobra.Command{
+	Use:   "get <download dir> <shard> <path...>",
+	Short: "Extract some files from the downloaded chunks",
+	Long: `Extracts only the given files of a shard, using its index (see
+"snapdown index", the index is built first if needed).
+
+Paths are relative to the archive, or to the shard directory, and can be
+patterns, for example:
+	snapdown get ./snapshot 0 'MANIFEST-*' 'OPTIONS-*' -o /tmp/shard-0`,
+	Run: getRun,
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+	indexCmd.Flags().IntSlice("shards", []int{0, 1, 2}, "List of shard indices (e.g. --shards=0,1,2)")
+
+	rootCmd.AddCommand(getCmd)
+	getCmd.Flags().StringP("output", "o", ".", "Directory to extract the files to")
+	getCmd.Flags().Bool("stdout", false, "Write the content of the files to stdout")
+}
+
+func indexRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Please set the download dir")
+		os.Exit(1)
+	}
+	indexShards, _ := cmd.Flags().GetIntSlice("shards")
+	for _, shard := range indexShards {
+		index := buildIndex(args[0], shard)
+		fmt.Printf("Shard %d: %d entries indexed in %s\n", shard, len(index.Entries), downloader.IndexPath(args[0], shard))
+	}
+}
+
+func buildIndex(srcDir string, shard int) *downloader.Index {
+	src, err := downloader.DirChunks(srcDir, shard)
+	if err != nil {
+		fmt.Printf("Shard %d: %v\n", shard, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Indexing shard %d, this reads the whole archive...\n", shard)
+	index, err := downloader.BuildIndex(src, downloader.IndexPath(srcDir, shard), shard)
+	if err != nil {
+		fmt.Printf("Shard %d: %v\n", shard, err)
+		os.Exit(1)
+	}
+	return index
+}
+
+// mustShardIndex returns the chunks of a shard, and their index, which is
+// built first if it is missing or out of date.
+func mustShardIndex(srcDir string, shard int) (downloader.ChunkSource, *downloader.Index) {
+	src, err := downloader.DirChunks(srcDir, shard)
+	if err != nil {
+		fmt.Printf("Shard %d: %v\n", shard, err)
+		os.Exit(1)
+	}
+	head, err := downloader.ArchiveHead(src)
+	if err != nil {
+		fmt.Printf("Shard %d: %v\n", shard, err)
+		os.Exit(1)
+	}
+	index, err := downloader.ReadIndex(downloader.IndexPath(srcDir, shard))
+	if err == nil && index.Head != head {
+		fmt.Printf("The index of shard %d is out of date.\n", shard)
+	}
+	if err != nil || index.Head != head {
+		index = buildIndex(srcDir, shard)
+	}
+	return src, index
+}
+
+func getRun(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		fmt.Println("Please set the download dir, the shard and the paths to extract")
+		os.Exit(1)
+	}
+	srcDir := args[0]
+	shard, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Printf("Invalid shard %q\n", args[1])
+		os.Exit(1)
+	}
+	dstDir, _ := cmd.Flags().GetString("output")
+	toStdout, _ := cmd.Flags().GetBool("stdout")
+
+	src, index := mustShardIndex(srcDir, shard)
+	entries, err := index.Match(shard, args[2:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if toStdout {
+		for _, e := range entries {
+			if err := index.WriteEntry(src, e, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	progressCh := make(chan downloader.XUpdMsg, 1000)
+	go func() {
+		if err := index.ExtractEntries(src, entries, dstDir, shard, progressCh); err != nil {
+			progressCh <- downloader.XUpdMsg{Shard: shard, Error: err}
+		}
+		progressCh <- downloader.XUpdMsg{Quit: true}
+	}()
+	model := ui.NewNoTtyExtract(shard, progressCh)
+	model.Run()
+	if len(model.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vrypan/snapdown/downloader"
+	"github.com/vrypan/snapdown/ui"
+)
+
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show details about the current remote snapshot",
+	Long: `Shows, for each shard, the snapshot that "download" would fetch,
+its age, number of chunks and compressed size, without downloading it.
+
+The disk space estimate covers the downloaded chunks plus the extracted
+database. Extracted size is estimated as compressed size x --ratio.`,
+	Run: infoRun,
+}
+
+type shardInfo struct {
+	Shard     int    `json:"shard"`
+	KeyBase   string `json:"key_base"`
+	Timestamp int    `json:"timestamp"`
+	Time      string `json:"time"`
+	Age       string `json:"age"`
+	Chunks    int    `json:"chunks"`
+	Size      int64  `json:"size"`
+}
+
+type snapshotInfo struct {
+	Endpoint      string      `json:"endpoint"`
+	Network       string      `json:"network"`
+	Shards        []shardInfo `json:"shards"`
+	TotalChunks   int         `json:"total_chunks"`
+	TotalSize     int64       `json:"total_size"`
+	ExtractedSize int64       `json:"estimated_extracted_size"`
+	DiskNeeded    int64       `json:"estimated_disk_needed"`
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+	infoCmd.Flags().IntSlice("shards", []int{0, 1, 2}, "List of shard indices (e.g. --shards=0,1,2)")
+	infoCmd.Flags().IntP("jobs", "j", 16, "Number of concurrent HEAD requests.")
+	infoCmd.Flags().Float64("ratio", downloader.ExtractRatio, "Estimated extracted/compressed size ratio")
+	infoCmd.Flags().String("endpoint", endpointURL, "Snapshot server URL")
+	infoCmd.Flags().Bool("testnet", false, "Use the testnet")
+	infoCmd.Flags().StringSlice("snapshot", nil, "Inspect a specific snapshot instead of latest (see: snapdown list)")
+	infoCmd.Flags().Bool("json", false, "JSON output")
+}
+
+func infoRun(cmd *cobra.Command, args []string) {
+	endpoint, _ := cmd.Flags().GetString("endpoint")
+	if endpoint != "" {
+		endpointURL = endpoint
+	}
+	infoShards, _ := cmd.Flags().GetIntSlice("shards")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	ratio, _ := cmd.Flags().GetFloat64("ratio")
+	useTestnet, _ := cmd.Flags().GetBool("testnet")
+	pins, _ := cmd.Flags().GetStringSlice("snapshot")
+	asJson, _ := cmd.Flags().GetBool("json")
+
+	downloader.EndpointURL = endpointURL
+	if jobs > 0 {
+		downloader.Concurrency = jobs
+	}
+	if useTestnet {
+		downloader.Network = "TESTNET"
+	}
+
+	shardMetadata := pinnedShardMetadata(endpointURL, infoShards, pins)
+
+	info := snapshotInfo{
+		Endpoint: endpointURL,
+		Network:  downloader.Network,
+	}
+	for _, shard := range infoShards {
+		metadata := shardMetadata[shard]
+		size, err := downloader.SnapshotSize(metadata)
+		if err != nil {
+			fmt.Printf("Shard %d: %v\n", shard, err)
+			exit(1)
+		}
+		info.Shards = append(info.Shards, shardInfo{
+			Shard:     shard,
+			KeyBase:   metadata.KeyBase,
+			Timestamp: metadata.Timestamp,
+			Time:      time.UnixMilli(int64(metadata.Timestamp)).UTC().Format(time.RFC3339),
+			Age:       formatRelativeTime(int64(metadata.Timestamp)),
+			Chunks:    len(metadata.Chunks),
+			Size:      size,
+		})
+		info.TotalChunks += len(metadata.Chunks)
+		info.TotalSize += size
+	}
+	info.ExtractedSize = int64(float64(info.TotalSize) * ratio)
+	info.DiskNeeded = info.TotalSize + info.ExtractedSize
+
+	if asJson {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Printf("\nEndpoint: %s (%s)\n\n", info.Endpoint, info.Network)
+	fmt.Printf("%-5s  %-68s  %-20s  %8s  %6s  %10s\n", "Shard", "Key base", "Time (UTC)", "Age", "Chunks", "Size")
+	for _, s := range info.Shards {
+		fmt.Printf("%-5d  %-68s  %-20s  %8s  %6d  %10s\n", s.Shard, s.KeyBase, s.Time, s.Age, s.Chunks, ui.BytesHuman(s.Size))
+	}
+	fmt.Printf("%-5s  %-68s  %-20s  %8s  %6d  %10s\n\n", "Total", "", "", "", info.TotalChunks, ui.BytesHuman(info.TotalSize))
+	fmt.Printf("Estimated extracted size:  %s (x%.2f)\n", ui.BytesHuman(info.ExtractedSize), ratio)
+	fmt.Printf("Estimated disk needed:     %s (chunks + extracted)\n", ui.BytesHuman(info.DiskNeeded))
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vrypan/snapdown/downloader"
+	"github.com/vrypan/snapdown/ui"
+)
+
+var listCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List the snapshots available on the server",
+	Long: `Lists past snapshots for each shard, newest first.
+
+Use the key base (or a timestamp) with
+	snapdown download --snapshot <key_base|timestamp>
+to download a specific snapshot instead of the latest one.
+
+Listing requires an S3-compatible endpoint (ListObjectsV2).`,
+	Run: listRun,
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().IntSlice("shards", []int{0, 1, 2}, "List of shard indices (e.g. --shards=0,1,2)")
+	listCmd.Flags().IntP("limit", "n", 10, "Max number of snapshots to show per shard (0 = all)")
+	listCmd.Flags().String("endpoint", endpointURL, "Snapshot server URL")
+	listCmd.Flags().Bool("testnet", false, "Use the testnet")
+}
+
+func listRun(cmd *cobra.Command, args []string) {
+	endpoint, _ := cmd.Flags().GetString("endpoint")
+	if endpoint != "" {
+		endpointURL = endpoint
+	}
+	listShards, _ := cmd.Flags().GetIntSlice("shards")
+	limit, _ := cmd.Flags().GetInt("limit")
+	useTestnet, _ := cmd.Flags().GetBool("testnet")
+	if useTestnet {
+		downloader.Network = "TESTNET"
+	}
+
+	for _, shard := range listShards {
+		snapshots, err := downloader.ListSnapshots(endpointURL, shard)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("\nShard %d (%d snapshots)\n", shard, len(snapshots))
+		fmt.Printf("  %-70s %10s %7s %10s\n", "Key base", "Age", "Chunks", "Size")
+		for i, s := range snapshots {
+			if limit > 0 && i >= limit {
+				break
+			}
+			fmt.Printf("  %-70s %10s %7d %10s\n", s.KeyBase, formatRelativeTime(int64(s.Timestamp)), len(s.Chunks), ui.BytesHuman(s.Size))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/vrypan/snapdown/downloader"
+)
+
+// heldLocks are the directory locks of this run, by absolute path.
+var heldLocks = make(map[string]*downloader.DirLock)
+
+// lockDirs locks the directories this run writes to, so that another
+// run can not write to them at the same time. A directory that is
+// already locked by this run is skipped.
+func lockDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if heldLocks[abs] != nil {
+			continue
+		}
+		l, err := downloader.LockDir(abs)
+		if err != nil {
+			return err
+		}
+		if l.Stale != nil {
+			log.Printf("Taking over the lock of %s, left by %s", dir, l.Stale)
+		}
+		heldLocks[abs] = l
+	}
+	return nil
+}
+
+func mustLockDirs(dirs ...string) {
+	if err := lockDirs(dirs...); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		exit(1)
+	}
+}
+
+// releaseLocks removes the lock files of this run. Locks that are not
+// released are released by the system when the process exits, and taken
+// over by the next run.
+func releaseLocks() {
+	for abs, l := range heldLocks {
+		l.Unlock()
+		delete(heldLocks, abs)
+	}
+}
+
+// exit releases the locks of this run, and exits.
+func exit(code int) {
+	releaseLocks()
+	os.Exit(code)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vrypan/snapdown/downloader"
+	"github.com/vrypan/snapdown/ui"
+)
+
+// Below these, watchSpace warns that the run may fail.
+const (
+	lowSpace  = 1 << 30
+	lowInodes = 1000
+)
+
+const watchSpaceEvery = 30 * time.Second
+
+// With --delete-as-you-go, the chunks of a shard that are still on disk
+// at any time: the first one, and those after the last checkpoint.
+const deleteAsYouGoLag = 1 << 30
+
+// filesystemNeeds is what a run needs on one filesystem.
+type filesystemNeeds struct {
+	dir    string // the first directory of the run on this filesystem
+	space  downloader.DiskSpace
+	bytes  int64
+	inodes int64
+	parts  []string
+}
+
+// checkSpace compares the space this run needs with what is free on the
+// filesystems it writes to, and exits with the shortfall if there is not
+// enough, unless ignore is set.
+func checkSpace(needs []downloader.SpaceNeed, ignore bool) {
+	var filesystems []*filesystemNeeds
+	byDevice := make(map[uint64]*filesystemNeeds)
+	for _, need := range needs {
+		space, err := downloader.DiskFree(need.Dir)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Warning: can not check free disk space: %v\n", err)
+			return
+		}
+		fs := byDevice[space.Device]
+		if fs == nil {
+			fs = &filesystemNeeds{dir: need.Dir, space: space}
+			byDevice[space.Device] = fs
+			filesystems = append(filesystems, fs)
+		}
+		fs.bytes += need.Bytes
+		fs.inodes += need.Inodes
+		if need.Bytes > 0 {
+			fs.parts = append(fs.parts, fmt.Sprintf("%s of shard %d: %s (%s)", need.What, need.Shard, ui.BytesHuman(need.Bytes), need.Basis))
+		}
+	}
+
+	short := false
+	for _, fs := range filesystems {
+		if fs.bytes == 0 {
+			continue
+		}
+		fmt.Printf("Disk space needed on the filesystem of %s: %s, %s free\n", fs.dir, ui.BytesHuman(fs.bytes), ui.BytesHuman(fs.space.Free))
+		for _, part := range fs.parts {
+			fmt.Printf("  %s\n", part)
+		}
+		if fs.space.Free < fs.bytes {
+			fmt.Printf("Not enough disk space on the filesystem of %s: %s short\n", fs.dir, ui.BytesHuman(fs.bytes-fs.space.Free))
+			short = true
+		} else if fs.space.Free-fs.bytes < fs.bytes/20 {
+			fmt.Printf("Warning: only %s would be left on the filesystem of %s, and sizes are estimates\n", ui.BytesHuman(fs.space.Free-fs.bytes), fs.dir)
+		}
+		if fs.space.FreeInodes >= 0 && fs.space.FreeInodes < fs.inodes {
+			fmt.Printf("Not enough inodes on the filesystem of %s: about %d needed, %d free\n", fs.dir, fs.inodes, fs.space.FreeInodes)
+			short = true
+		}
+	}
+	if !short {
+		return
+	}
+	if ignore {
+		fmt.Println("Starting anyway (--ignore-space).")
+		return
+	}
+	fmt.Println("Free some space, or use --ignore-space to start anyway.")
+	exit(1)
+}
+
+// extractionDir is where checkSpace looks for the space needed to
+// extract a shard.
+func extractionDir(opts extractOptions, dstDir string, shard int) string {
+	if opts.inPlace {
+		return downloader.ShardDir(dstDir, shard)
+	}
+	return downloader.ShardDir(downloader.StagingDir(dstDir, shard), shard)
+}
+
+// extractionNeeds returns the space needed to extract shards from srcDir
+// to dstDir. Shards whose needs can not be estimated are skipped.
+func extractionNeeds(opts extractOptions, srcDir, dstDir string, shards []int, shardMetadata map[int]*downloader.Metadata) []downloader.SpaceNeed {
+	var needs []downloader.SpaceNeed
+	// Deleted chunks only make room for the extraction on their filesystem.
+	src, srcErr := downloader.DiskFree(srcDir)
+	dst, dstErr := downloader.DiskFree(dstDir)
+	freesRoom := downloader.DeleteConsumedChunks && srcErr == nil && dstErr == nil && src.Device == dst.Device
+	for _, shard := range shards {
+		need, err := downloader.ExtractSpace(srcDir, shard, shardMetadata[shard], extractionDir(opts, dstDir, shard))
+		if err != nil {
+			fmt.Printf("Warning: can not estimate the space needed to extract shard %d: %v\n", shard, err)
+			continue
+		}
+		need.Dir = dstDir // the staging directory is in it
+		if freesRoom {
+			need.Bytes = max(0, need.Bytes-max(0, need.Archive-deleteAsYouGoLag))
+			need.Basis += ", less the chunks deleted as it goes"
+		}
+		needs = append(needs, need)
+	}
+	return needs
+}
+
+// downloadNeeds returns the space needed to download shards to dir.
+func downloadNeeds(dir string, shards []int, shardMetadata map[int]*downloader.Metadata) []downloader.SpaceNeed {
+	var needs []downloader.SpaceNeed
+	for _, shard := range shards {
+		need, err := downloader.DownloadSpace(dir, shard, shardMetadata[shard])
+		if err != nil {
+			fmt.Printf("Warning: can not estimate the space needed to download shard %d: %v\n", shard, err)
+			continue
+		}
+		needs = append(needs, need)
+	}
+	return needs
+}
+
+// watchSpace checks the free space of the filesystems of dirs while the
+// run is in progress, and calls warn when it runs low. Call the returned
+// function to stop.
+func watchSpace(dirs []string, warn func(string)) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(watchSpaceEvery)
+		defer ticker.Stop()
+		warned := make(map[uint64]bool)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			checked := make(map[uint64]bool)
+			for _, dir := range dirs {
+				space, err := downloader.DiskFree(dir)
+				if err != nil || checked[space.Device] {
+					continue
+				}
+				checked[space.Device] = true
+				var low []string
+				if space.Free < lowSpace {
+					low = append(low, ui.BytesHuman(space.Free))
+				}
+				if space.FreeInodes >= 0 && space.FreeInodes < lowInodes {
+					low = append(low, fmt.Sprintf("%d inodes", space.FreeInodes))
+				}
+				if len(low) > 0 && !warned[space.Device] {
+					warn(fmt.Sprintf("running out of disk space: %s left on the filesystem of %s", strings.Join(low, " and "), dir))
+				}
+				warned[space.Device] = len(low) > 0
+			}
+		}
+	}()
+	return func() { close(done) }
+}
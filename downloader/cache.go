@@ -0,0 +1,155 @@
+package downloader
+
+/*
+Low page cache impact.
+
+Reading and writing a snapshot goes through the page cache, and pushes
+out of it what other processes use: on a host that runs a node, the hot
+blocks of its database. With LowCache, the pages of the chunks and of
+the extracted files are dropped from the cache as snapdown goes through
+them (on Linux):
+
+	reads   dropped behind the reader, every dropCacheEvery bytes
+	writes  written back, then dropped, dropCacheEvery bytes behind
+	        the writer: pages can only be dropped once on disk
+	tar     the files extracted by tar are written back and dropped
+	        once they are complete
+
+With DirectIO, chunks are downloaded with O_DIRECT, and do not go
+through the cache at all.
+*/
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// LowCache makes snapdown drop what it reads and writes from the page
+// cache.
+var LowCache = false
+
+// DirectIO makes downloads write chunks with O_DIRECT, where the
+// filesystem supports it.
+var DirectIO = false
+
+const dropCacheEvery = 8 << 20
+
+// outputFile is a file that is written sequentially.
+type outputFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// cacheFile is a file that is read or written sequentially, and whose
+// pages are dropped from the cache behind the reader or the writer.
+type cacheFile struct {
+	*os.File
+	write   bool
+	pos     int64 // bytes read or written
+	flushed int64 // writes before it are being written back
+	dropped int64 // pages before it are dropped
+	closed  bool
+}
+
+// readCache returns f, that drops its pages as it is read with LowCache.
+func readCache(f *os.File) io.ReadCloser {
+	if !LowCache {
+		return f
+	}
+	return &cacheFile{File: f}
+}
+
+// writeCache returns f, that drops its pages as it is written with
+// LowCache.
+func writeCache(f *os.File) outputFile {
+	if !LowCache {
+		return f
+	}
+	return &cacheFile{File: f, write: true}
+}
+
+func (f *cacheFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.advance(n)
+	return n, err
+}
+
+func (f *cacheFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.advance(n)
+	return n, err
+}
+
+// Seek is used to resume reading a chunk in the middle.
+func (f *cacheFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil && !f.write {
+		f.pos, f.flushed, f.dropped = pos, pos, pos
+	}
+	return pos, err
+}
+
+func (f *cacheFile) advance(n int) {
+	f.pos += int64(n)
+	if f.pos-f.flushed < dropCacheEvery {
+		return
+	}
+	if f.write {
+		// What was written since the last call is written back while
+		// the writer goes on, the previous part is dropped once on disk.
+		startWriteback(f.File, f.flushed, f.pos-f.flushed)
+		if f.flushed > f.dropped {
+			waitWriteback(f.File, f.dropped, f.flushed-f.dropped)
+			dropCache(f.File, f.dropped, f.flushed-f.dropped)
+		}
+		f.dropped, f.flushed = f.flushed, f.pos
+		return
+	}
+	dropCache(f.File, f.dropped, f.pos-f.dropped)
+	f.dropped, f.flushed = f.pos, f.pos
+}
+
+func (f *cacheFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		if f.write {
+			waitWriteback(f.File, f.dropped, 0)
+		}
+		dropCache(f.File, f.dropped, 0)
+	}
+	return f.File.Close()
+}
+
+// dropFileCache drops the pages of a file that is complete, once they
+// are written back.
+func dropFileCache(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	waitWriteback(f, 0, 0)
+	dropCache(f, 0, 0)
+}
+
+var directUnsupported sync.Once
+
+// createChunk creates the file a chunk of size bytes is downloaded to.
+// warn is called once if DirectIO can not be used.
+func createChunk(path string, size int64, warn func(error)) (outputFile, error) {
+	if DirectIO {
+		f, err := createDirect(path, size)
+		if err == nil {
+			return f, nil
+		}
+		directUnsupported.Do(func() { warn(err) })
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	preallocate(f, size)
+	return writeCache(f), nil
+}
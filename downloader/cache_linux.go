@@ -0,0 +1,121 @@
+package downloader
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// In the functions below, n = 0 means up to the end of the file. Errors
+// are ignored: the cache is only an optimization.
+
+func dropCache(f *os.File, offset, n int64) {
+	unix.Fadvise(int(f.Fd()), offset, n, unix.FADV_DONTNEED)
+}
+
+func startWriteback(f *os.File, offset, n int64) {
+	unix.SyncFileRange(int(f.Fd()), offset, n, unix.SYNC_FILE_RANGE_WRITE)
+}
+
+func waitWriteback(f *os.File, offset, n int64) {
+	unix.SyncFileRange(int(f.Fd()), offset, n, unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+}
+
+const (
+	directAlign      = 4096
+	directBufferSize = 1 << 20
+)
+
+// directFile writes a file with O_DIRECT, through an aligned buffer. The
+// end of the file, that is not a multiple of the block size, is written
+// with O_DIRECT turned off.
+type directFile struct {
+	f   *os.File
+	buf []byte
+	n   int // bytes in buf
+}
+
+func createDirect(path string, size int64) (*directFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|unix.O_DIRECT, 0666)
+	if err != nil {
+		return nil, err
+	}
+	preallocate(f, size)
+	buf := make([]byte, directBufferSize+directAlign)
+	skip := directAlign - int(uintptr(unsafe.Pointer(&buf[0]))%directAlign)
+	return &directFile{f: f, buf: buf[skip%directAlign:][:directBufferSize]}, nil
+}
+
+func (d *directFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(d.buf[d.n:], p)
+		d.n += n
+		p = p[n:]
+		written += n
+		if d.n == len(d.buf) {
+			if err := d.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the blocks of buf that are complete.
+func (d *directFile) flush() error {
+	blocks := d.n - d.n%directAlign
+	if blocks == 0 {
+		return nil
+	}
+	if _, err := d.f.Write(d.buf[:blocks]); err != nil {
+		return err
+	}
+	d.n = copy(d.buf, d.buf[blocks:d.n])
+	return nil
+}
+
+// finish writes what is left in buf.
+func (d *directFile) finish() error {
+	if err := d.flush(); err != nil || d.n == 0 {
+		return err
+	}
+	flags, err := unix.FcntlInt(d.f.Fd(), unix.F_GETFL, 0)
+	if err == nil {
+		_, err = unix.FcntlInt(d.f.Fd(), unix.F_SETFL, flags&^unix.O_DIRECT)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := d.f.Write(d.buf[:d.n]); err != nil {
+		return err
+	}
+	d.n = 0
+	waitWriteback(d.f, 0, 0)
+	dropCache(d.f, 0, 0)
+	return nil
+}
+
+func (d *directFile) Sync() error {
+	if err := d.finish(); err != nil {
+		return err
+	}
+	return d.f.Sync()
+}
+
+func (d *directFile) Close() error {
+	err := d.finish()
+	if e := d.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// preallocate reserves size bytes for f, so that it is written to
+// contiguous blocks. The size of f does not change: a file that is not
+// completely written does not look complete.
+func preallocate(f *os.File, size int64) {
+	// Not all filesystems support it, and it is only an optimization.
+	unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+func dropCache(f *os.File, offset, n int64) {}
+
+func startWriteback(f *os.File, offset, n int64) {}
+
+func waitWriteback(f *os.File, offset, n int64) {}
+
+func preallocate(f *os.File, size int64) {}
+
+func createDirect(path string, size int64) (outputFile, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,219 @@
+package downloader
+
+/*
+Resumable extraction.
+
+While the "go" decompressor extracts a gzip archive, a checkpoint
+(see inflate.go) is saved every checkpointEvery bytes in the
+shard's directory. A checkpoint is only saved once all the tar
+entries before it have been extracted, together with the list of
+the files extracted so far.
+
+Unless Fsync is FsyncNever, the files listed in a checkpoint are synced
+before it is saved (see durable.go).
+
+When an extraction is interrupted, the next one finds the checkpoint,
+checks that the files listed in it are on disk, with the right size
+and modification time, and resumes decompression from there.
+
+	compressed:   |----chunk 1----|----chunk 2----|----chunk 3----|
+	checkpoint:                       ^ In/Bits  (block boundary)
+	decompressed: |---entry---|--entry--|-------entry-------|-----
+	                                  ^ Out    ^ Entry
+*/
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CheckpointFile is left in the directory of a shard whose extraction
+// did not complete.
+const CheckpointFile = "snapdown.checkpoint"
+
+const (
+	checkpointEvery = 256 << 20 // 256MB of decompressed data
+	// Bytes fed to tar that it may not have extracted yet: more than its
+	// stdin pipe and read buffer can hold.
+	tarPipeSlack = 4 << 20
+)
+
+// shardCheckpoint is the content of CheckpointFile.
+type shardCheckpoint struct {
+	// Head is the CRC-32 of the first 512 bytes of the archive, so that
+	// the checkpoint of another snapshot is not used by mistake.
+	Head uint32 `json:"head"`
+	// Entry is the offset in the tar stream of the first entry that is
+	// not extracted yet.
+	Entry int64           `json:"entry"`
+	Gzip  gzipCheckpoint  `json:"gzip"`
+	Files []extractedFile `json:"files"`
+}
+
+type extractedFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// checkpointer collects checkpoints from the decompressor, and saves
+// them once the entries that precede them are extracted.
+type checkpointer struct {
+	path string
+	head uint32
+	dir  string // where the files are extracted
+
+	mu         sync.Mutex
+	candidates []gzipCheckpoint
+	boundaries []entryBoundary
+	files      []extractedFile
+	saved      int64 // Out of the last saved checkpoint
+	synced     int   // files that have been synced
+	// onSave, if set, is called with the In of every saved checkpoint.
+	onSave func(in int64)
+}
+
+// entryBoundary is where a tar entry starts, and how many files
+// precede it.
+type entryBoundary struct {
+	offset int64
+	files  int
+}
+
+func checkpointPath(dstDir string, shardId int) string {
+	return filepath.Join(ShardDir(dstDir, shardId), CheckpointFile)
+}
+
+func hasCheckpoint(dstDir string, shardId int) bool {
+	_, err := os.Stat(checkpointPath(dstDir, shardId))
+	return err == nil
+}
+
+// candidate is called by the decompressor.
+func (c *checkpointer) candidate(cp gzipCheckpoint) {
+	c.mu.Lock()
+	c.candidates = append(c.candidates, cp)
+	c.mu.Unlock()
+}
+
+// entry records an entry of the tar stream, that starts at offset.
+func (c *checkpointer) entry(offset int64, hdr *tar.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.boundaries = append(c.boundaries, entryBoundary{offset: offset, files: len(c.files)})
+	if hdr.Typeflag == tar.TypeReg {
+		c.files = append(c.files, extractedFile{Name: hdr.Name, Size: hdr.Size, ModTime: hdr.ModTime.Unix()})
+	}
+}
+
+// extracted is called when everything before offset, in the tar stream,
+// has been extracted. It saves the latest checkpoint that can be used
+// from there.
+func (c *checkpointer) extracted(offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := -1
+	for b+1 < len(c.boundaries) && c.boundaries[b+1].offset <= offset {
+		b++
+	}
+	if b < 0 {
+		return
+	}
+	boundary := c.boundaries[b]
+	c.boundaries = c.boundaries[b+1:]
+
+	cp := -1
+	for cp+1 < len(c.candidates) && c.candidates[cp+1].Out <= boundary.offset {
+		cp++
+	}
+	if cp < 0 || c.candidates[cp].Out-c.saved < checkpointEvery {
+		return
+	}
+	saved := shardCheckpoint{
+		Head:  c.head,
+		Entry: boundary.offset,
+		Gzip:  c.candidates[cp],
+		Files: c.files[:boundary.files],
+	}
+	c.candidates = c.candidates[cp+1:]
+	// A checkpoint that can not be saved only makes the
+	// extraction not resumable, so errors are ignored.
+	if err := c.sync(boundary.files); err != nil {
+		return
+	}
+	if err := writeCheckpoint(c.path, &saved); err == nil {
+		c.saved = saved.Gzip.Out
+		if c.onSave != nil {
+			c.onSave(saved.Gzip.In)
+		}
+	}
+}
+
+// sync syncs the first n extracted files, that the next checkpoint lists.
+func (c *checkpointer) sync(n int) error {
+	if Fsync == FsyncNever {
+		return nil
+	}
+	files := make([]string, 0, n-c.synced)
+	for _, f := range c.files[c.synced:n] {
+		files = append(files, filepath.Join(c.dir, f.Name))
+	}
+	if err := syncFiles(files); err != nil {
+		return err
+	}
+	c.synced = n
+	return nil
+}
+
+// done removes the checkpoint, once the shard is completely extracted.
+func (c *checkpointer) done() {
+	os.Remove(c.path)
+}
+
+func writeCheckpoint(path string, cp *shardCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ReplaceFile(path, data)
+}
+
+// loadCheckpoint returns the checkpoint of an interrupted extraction
+// of the archive with the given head, after checking that the files
+// it lists are still there. It returns nil if there is none.
+func loadCheckpoint(path, dstDir string, head uint32) (*shardCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp shardCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if cp.Head != head {
+		return nil, fmt.Errorf("%s is for another snapshot", path)
+	}
+	if cp.Entry < cp.Gzip.Out || len(cp.Gzip.Window) > inflateWindow {
+		return nil, fmt.Errorf("invalid %s", path)
+	}
+	for _, f := range cp.Files {
+		info, err := os.Lstat(filepath.Join(dstDir, f.Name))
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() || info.Size() != f.Size || info.ModTime().Unix() != f.ModTime {
+			return nil, fmt.Errorf("%s has changed since it was extracted", f.Name)
+		}
+	}
+	return &cp, nil
+}
@@ -0,0 +1,77 @@
+package downloader
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// StaleFiles returns the files and directories of ShardDir(dstDir, shard)
+// that are not in the shard's archive, given the names of its entries.
+// A stale directory is returned without its content. The files written
+// by snapdown are not stale.
+func StaleFiles(dstDir string, shard int, entries []string) ([]string, error) {
+	root := filepath.Base(ShardDir(dstDir, shard))
+	keep := map[string]bool{
+		root:                            true,
+		path.Join(root, ProvenanceFile): true,
+		path.Join(root, CheckpointFile): true,
+	}
+	for _, name := range entries {
+		// Parent directories are not always entries
+		for name = path.Clean(name); name != "." && name != "/" && !keep[name]; name = path.Dir(name) {
+			keep[name] = true
+		}
+	}
+
+	var stale []string
+	err := filepath.WalkDir(ShardDir(dstDir, shard), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == ShardDir(dstDir, shard) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dstDir, p)
+		if err != nil {
+			return err
+		}
+		if keep[filepath.ToSlash(rel)] {
+			return nil
+		}
+		stale = append(stale, p)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return stale, err
+}
+
+// RemoveStale removes the given files and directories of dstDir. If
+// trashDir is set, they are moved there, under the same path relative
+// to dstDir, instead. trashDir must be on the same filesystem.
+func RemoveStale(dstDir string, stale []string, trashDir string) error {
+	for _, p := range stale {
+		if trashDir == "" {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		}
+		rel, err := filepath.Rel(dstDir, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(trashDir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		os.RemoveAll(target) // from a previous clean
+		if err := os.Rename(p, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Archive formats, detected from the magic bytes of the first chunk.
+const (
+	FormatGzip = "gzip"
+	FormatZstd = "zstd"
+	FormatTar  = "tar"
+)
+
+// Decompressors that can be used with --decompressor, besides "auto".
+// "go" is our own gzip decompressor (see inflate.go), "none" is for uncompressed tar archives,
+// the rest are external programs that must be in PATH.
+var decompressorFormats = map[string]string{
+	"go":    FormatGzip,
+	"igzip": FormatGzip,
+	"pigz":  FormatGzip,
+	"gzip":  FormatGzip,
+	"zstd":  FormatZstd,
+	"none":  FormatTar,
+}
+
+// Preferred external decompressors, fastest first.
+var autoDecompressors = map[string][]string{
+	FormatGzip: {"igzip", "pigz"},
+	FormatZstd: {"zstd"},
+}
+
+// DetectFormat looks at the first bytes of an archive to tell
+// if it is a gzip, zstd or plain tar stream.
+func DetectFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(f, header)
+	format, err := formatOf(header[:n])
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return format, nil
+}
+
+func formatOf(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return FormatGzip, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return FormatTar, nil
+	}
+	return "", fmt.Errorf("unknown archive format")
+}
+
+// Decompressor turns a compressed stream into a tar stream.
+type Decompressor struct {
+	Name string
+}
+
+// ChooseDecompressor returns the decompressor to use for an archive of the
+// given format. name is the user's choice, or "auto" to pick the fastest
+// available one. fallback is used for gzip archives when no accelerated
+// decompressor is installed.
+func ChooseDecompressor(name, format, fallback string) (Decompressor, error) {
+	if name == "" || name == "auto" {
+		for _, candidate := range autoDecompressors[format] {
+			if _, err := exec.LookPath(candidate); err == nil {
+				return Decompressor{Name: candidate}, nil
+			}
+		}
+		switch format {
+		case FormatGzip:
+			name = fallback
+		case FormatTar:
+			name = "none"
+		default:
+			return Decompressor{}, fmt.Errorf("%s archive: no decompressor found, please install %s", format, strings.Join(autoDecompressors[format], " or "))
+		}
+	}
+
+	supported, ok := decompressorFormats[name]
+	if !ok {
+		return Decompressor{}, fmt.Errorf("unknown decompressor %q", name)
+	}
+	if supported != format {
+		return Decompressor{}, fmt.Errorf("decompressor %s can not read %s archives", name, format)
+	}
+	if name != "go" && name != "none" {
+		if _, err := exec.LookPath(name); err != nil {
+			return Decompressor{}, fmt.Errorf("decompressor %s not found in PATH", name)
+		}
+	}
+	return Decompressor{Name: name}, nil
+}
+
+// Reader returns the decompressed stream of r. Closing it releases the
+// decompressor, and reports its errors (like a failed checksum).
+func (d Decompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	switch d.Name {
+	case "none":
+		return io.NopCloser(r), nil
+	case "go":
+		return newInflater(r), nil
+	}
+
+	cmd := exec.Command(d.Name, "-d", "-c")
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+// cmdReader reads the output of an external decompressor.
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *cmdReader) Close() error {
+	io.Copy(io.Discard, c.ReadCloser)
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v %s", c.cmd.Path, err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// abortReader releases a decompressed stream without reading it to the end.
+func abortReader(rc io.ReadCloser) {
+	switch r := rc.(type) {
+	case *cmdReader:
+		r.cmd.Process.Kill()
+		r.ReadCloser.Close()
+		r.cmd.Wait()
+	case *inflater:
+		// nothing to release
+	default:
+		rc.Close()
+	}
+}
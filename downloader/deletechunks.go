@@ -0,0 +1,188 @@
+package downloader
+
+/*
+Deleting chunks once they are extracted.
+
+DeleteChunks removes the chunks of a shard once it has been extracted.
+With DeleteConsumedChunks, chunks are also deleted while the shard is
+extracted, once a checkpoint past their end has been saved, so that an
+interrupted extraction can still be resumed:
+
+	chunks:     |--chunk 0--|--chunk 1--|--chunk 2--|--chunk 3--|
+	checkpoint:                             ^ In
+	deleted:                |-----------|
+
+The first chunk is kept until the end, it identifies the archive.
+Deleted chunks are recorded with their size in <download dir>/shard-N.deleted,
+so that neither resuming the download nor resuming the extraction
+needs them.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DeleteConsumedChunks makes extractions delete the chunks they have
+// read, as soon as they are no longer needed to resume.
+var DeleteConsumedChunks = false
+
+// DeletedChunksPath returns the file that records the deleted chunks of
+// a shard.
+func DeletedChunksPath(rootDir string, shard int) string {
+	return filepath.Join(rootDir, fmt.Sprintf("shard-%d.deleted", shard))
+}
+
+// DeleteChunks removes the chunks of a shard and its index. metadata.json
+// is removed with the chunks of the last shard.
+func DeleteChunks(rootDir string, shard int) error {
+	if err := os.RemoveAll(filepath.Join(rootDir, fmt.Sprintf("shard-%d", shard))); err != nil {
+		return err
+	}
+	for _, path := range []string{IndexPath(rootDir, shard), DeletedChunksPath(rootDir, shard), syncedChunksPath(rootDir, shard)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	shardMetadata, _ := ReadLocalMetadata(rootDir)
+	for other := range shardMetadata {
+		if exists(filepath.Join(rootDir, fmt.Sprintf("shard-%d", other))) {
+			return nil
+		}
+	}
+	if err := os.Remove(filepath.Join(rootDir, "metadata.json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deletions are the deleted chunks of a shard.
+type deletions struct {
+	path  string
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+// loadDeletions reads the deleted chunks of a shard. A record that can
+// not be read is treated as empty: the chunks it lists are then missing.
+func loadDeletions(rootDir string, shard int) *deletions {
+	d := &deletions{path: DeletedChunksPath(rootDir, shard), sizes: make(map[string]int64)}
+	if data, err := os.ReadFile(d.path); err == nil {
+		json.Unmarshal(data, &d.sizes)
+	}
+	return d
+}
+
+// size returns the size of a chunk, if it has been deleted.
+func (d *deletions) size(name string) (int64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size, ok := d.sizes[name]
+	return size, ok
+}
+
+// names returns the names of the deleted chunks.
+func (d *deletions) names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.sizes))
+	for name := range d.sizes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// remove records that a chunk is deleted, and deletes it.
+func (d *deletions) remove(path string, size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sizes[filepath.Base(path)] = size
+	data, err := json.Marshal(d.sizes)
+	if err != nil {
+		return err
+	}
+	if err := ReplaceFile(d.path, data); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// open opens a chunk, and says why if it has been deleted.
+func (d *deletions) open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, deleted := d.size(filepath.Base(path)); deleted {
+			return nil, fmt.Errorf("%s was deleted once extracted (--delete-as-you-go), the shard can only be extracted from the start after downloading it again", path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readCache(f), nil
+}
+
+// chunkFiles is implemented by the chunk sources whose chunks are files
+// in the download directory.
+type chunkFiles interface {
+	ChunkSource
+	chunkPath(i int) string
+	deleted() *deletions
+}
+
+// chunkSize returns the size of a chunk, deleted or not.
+func chunkSize(src chunkFiles, i int) (int64, error) {
+	path := src.chunkPath(i)
+	if size, ok := src.deleted().size(filepath.Base(path)); ok {
+		return size, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// chunkDeleter deletes the chunks of a source that end before the
+// compressed offset of the checkpoints that are saved.
+type chunkDeleter struct {
+	src      chunkFiles
+	next     int   // the chunks before it, except the first one, are deleted
+	start    int64 // where chunk next starts
+	progress func(string)
+}
+
+func newChunkDeleter(src chunkFiles, progress func(string)) (*chunkDeleter, error) {
+	first, err := chunkSize(src, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkDeleter{src: src, next: 1, start: first, progress: progress}, nil
+}
+
+// saved is called when a checkpoint that resumes from offset in has
+// been saved.
+func (d *chunkDeleter) saved(in int64) {
+	first := d.next
+	for ; d.next < d.src.Len(); d.next++ {
+		size, err := chunkSize(d.src, d.next)
+		if err != nil || d.start+size > in {
+			break
+		}
+		if err := d.src.deleted().remove(d.src.chunkPath(d.next), size); err != nil {
+			d.progress(fmt.Sprintf("could not delete %s: %v", d.src.chunkPath(d.next), err))
+			break
+		}
+		d.start += size
+	}
+	if d.next > first {
+		d.progress(fmt.Sprintf("deleted the extracted chunks up to %s", filepath.Base(d.src.chunkPath(d.next-1))))
+	}
+}
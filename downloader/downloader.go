@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -17,6 +18,13 @@ var (
 	ProgressChan   chan<- ProgressUpdate
 	CheckSizes     = true
 	Network        = "MAINNET"
+	// ExtractRatio is used to estimate the extracted size of a snapshot
+	// from its compressed size. SSTs are already compressed, so gzip does
+	// not gain much, but we err on the safe side.
+	ExtractRatio = 1.5
+	// ChunkDone, if set, is called by Download every time a chunk has been
+	// downloaded (or found complete locally), or has failed.
+	ChunkDone func(shard int, chunk string, err error)
 )
 
 type ProgressUpdate struct {
@@ -28,12 +36,20 @@ type ProgressUpdate struct {
 	BytesTotal      int64
 	Quit            bool
 	Error           error
+	Warning         string // a problem that does not stop the download
 }
 
 type Metadata struct {
 	KeyBase   string   `json:"key_base"`
 	Chunks    []string `json:"chunks"`
 	Timestamp int      `json:"timestamp"`
+	// Endpoint is not part of latest.json, it is set by snapdown to
+	// remember where the snapshot was downloaded from.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Sizes are the remote sizes of the chunks, in order. They are set by
+	// snapdown once the chunks are downloaded, so that an incomplete chunk
+	// can be told from a complete one.
+	Sizes []int64 `json:"sizes,omitempty"`
 }
 
 func ShardMetadata(endpointURL string, shard int) (*Metadata, error) {
@@ -49,6 +65,13 @@ func ShardMetadata(endpointURL string, shard int) (*Metadata, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
 		return nil, fmt.Errorf("Error decoding metadata: %v\n", err)
 	}
+	if err := metadata.Validate(shard); err != nil {
+		return nil, fmt.Errorf("%s: %v", metadataURL, err)
+	}
+	if network := KeyBaseNetwork(metadata.KeyBase); network != Network {
+		return nil, fmt.Errorf("%s: invalid metadata for shard %d: key base %s is for %s, not %s", metadataURL, shard, metadata.KeyBase, network, Network)
+	}
+	metadata.Endpoint = endpointURL
 	return &metadata, nil
 }
 
@@ -89,10 +112,14 @@ func sendProgressUpdate(ch chan<- ProgressUpdate, update ProgressUpdate) {
 
 func Download(shard int, metadata *Metadata) {
 	progressChan := ProgressChan
+	if err := metadata.Validate(shard); err != nil {
+		sendProgressUpdate(progressChan, ProgressUpdate{Error: err})
+		return
+	}
 	baseURL := fmt.Sprintf("%s/%s", EndpointURL, metadata.KeyBase)
 	outputDir := filepath.Join(OutputBasePath, fmt.Sprintf("shard-%d", shard))
 	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
+		sendProgressUpdate(progressChan, ProgressUpdate{Error: fmt.Errorf("shard=%d: %v", shard, err)})
 		return
 	}
 	type chunkJob struct {
@@ -102,17 +129,40 @@ func Download(shard int, metadata *Metadata) {
 
 	chunkJobs := make(chan chunkJob)
 	var wg sync.WaitGroup
+	sizes := make([]int64, len(metadata.Chunks))
+	var failed atomic.Bool
+	deleted := loadDeletions(OutputBasePath, shard)
+	synced := loadSyncedChunks(OutputBasePath, shard)
+	if err := synced.start(outputDir); err != nil {
+		sendProgressUpdate(progressChan, ProgressUpdate{Error: fmt.Errorf("shard=%d: %v", shard, err)})
+		return
+	}
 
 	worker := func() {
 		buf := make([]byte, 128*1024) // Pre-allocated buffer per worker
 		for job := range chunkJobs {
 			chunk := job.chunk
 			url := fmt.Sprintf("%s/%s", baseURL, chunk)
-			if err := downloadChunk(shard, url, filepath.Join(outputDir, chunk), progressChan, chunk, buf); err != nil {
+			var err error
+			if size, ok := deleted.size(chunk); ok {
+				// Already extracted, see DeleteConsumedChunks
+				sendProgressUpdate(progressChan, ProgressUpdate{
+					Shard: shard, ChunkName: chunk,
+					BytesDownloaded: size, BytesTotal: size,
+					Done: true})
+				sizes[job.idx] = size
+			} else {
+				sizes[job.idx], err = downloadChunk(shard, url, filepath.Join(outputDir, chunk), synced.trusted(chunk), progressChan, chunk, buf)
+			}
+			if err != nil {
+				failed.Store(true)
 				sendProgressUpdate(progressChan, ProgressUpdate{
 					Error: fmt.Errorf("shard=%d, url=%s, path=%s, error=%v", shard, url, filepath.Join(outputDir, chunk), err),
 				})
 			}
+			if ChunkDone != nil {
+				ChunkDone(shard, chunk, err)
+			}
 			wg.Done()
 		}
 	}
@@ -127,45 +177,88 @@ func Download(shard int, metadata *Metadata) {
 	}
 	close(chunkJobs)
 	wg.Wait()
+	if err := synced.finish(outputDir); err != nil {
+		sendProgressUpdate(progressChan, ProgressUpdate{Error: fmt.Errorf("shard=%d: syncing the chunks: %v", shard, err)})
+	}
+	if !failed.Load() {
+		metadata.Sizes = sizes
+		if err := recordChunkSizes(OutputBasePath, shard, metadata); err != nil {
+			sendProgressUpdate(progressChan, ProgressUpdate{Error: fmt.Errorf("shard=%d: recording the chunk sizes: %v", shard, err)})
+		}
+	}
 }
 
-func downloadChunk(shard int, url, path string, progressChan chan<- ProgressUpdate, chunkName string, buf []byte) error {
-	if _, err := os.Stat(path); err == nil {
+var metadataMu sync.Mutex
+
+// recordChunkSizes saves the chunk sizes of metadata in the metadata.json
+// of rootDir, if it lists the same snapshot for shard.
+func recordChunkSizes(rootDir string, shard int, metadata *Metadata) error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	shardMetadata, err := ReadLocalMetadata(rootDir)
+	if err != nil {
+		return err
+	}
+	local := shardMetadata[shard]
+	if local == nil || local.KeyBase != metadata.KeyBase {
+		return nil
+	}
+	local.Sizes = metadata.Sizes
+	data, err := json.MarshalIndent(shardMetadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ReplaceFile(filepath.Join(rootDir, "metadata.json"), data)
+}
+
+// downloadChunk downloads a chunk to path, unless it is there already,
+// and returns its size. A chunk that is not trusted is downloaded again,
+// even if it has the right size (see durable.go).
+func downloadChunk(shard int, url, path string, trusted bool, progressChan chan<- ProgressUpdate, chunkName string, buf []byte) (int64, error) {
+	if _, err := os.Stat(path); err == nil && trusted {
 		match, downloadedBytes, err := isLocalFileComplete(path, url)
 		if err != nil {
-			return fmt.Errorf("  [!] Error checking remote file: %v\n", err)
+			return 0, fmt.Errorf("  [!] Error checking remote file: %v\n", err)
 		} else if match {
 			sendProgressUpdate(progressChan, ProgressUpdate{
 				Shard: shard, ChunkName: chunkName,
 				BytesDownloaded: downloadedBytes, BytesTotal: downloadedBytes,
 				Done: true})
-			return nil
+			return downloadedBytes, nil
 		}
 	}
 
 	resp, err := http.Get(url)
 	if err != nil {
-		return fmt.Errorf("http get failed: %w", err)
+		return 0, fmt.Errorf("http get failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	out, err := os.Create(path)
+	total := resp.ContentLength
+	if total <= 0 {
+		return 0, fmt.Errorf("invalid content length: %d", total)
+	}
+	return total, writeChunk(shard, resp.Body, total, path, progressChan, chunkName, buf)
+}
+
+// writeChunk writes the total bytes of body to path, through a .part file.
+func writeChunk(shard int, body io.Reader, total int64, path string, progressChan chan<- ProgressUpdate, chunkName string, buf []byte) error {
+
+	part := path + partSuffix
+	out, err := createChunk(part, total, func(err error) {
+		sendProgressUpdate(progressChan, ProgressUpdate{Warning: fmt.Sprintf("writing chunks through the page cache, O_DIRECT can not be used: %v", err)})
+	})
 	if err != nil {
 		return fmt.Errorf("create file failed: %w", err)
 	}
 	defer out.Close()
 
-	total := resp.ContentLength
-	if total <= 0 {
-		return fmt.Errorf("invalid content length: %d", total)
-	}
-
 	const progressStep = 1 * 1024 * 1024
 	var downloaded int64
 	var lastReported int64
 
 	for {
-		n, err := resp.Body.Read(buf)
+		n, err := body.Read(buf)
 		if n > 0 {
 			if _, writeErr := out.Write(buf[:n]); writeErr != nil {
 				return fmt.Errorf("write failed: %w", writeErr)
@@ -187,5 +280,120 @@ func downloadChunk(shard int, url, path string, progressChan chan<- ProgressUpda
 			return fmt.Errorf("read failed: %w", err)
 		}
 	}
+	if Fsync == FsyncChunk {
+		if err := out.Sync(); err != nil {
+			return fmt.Errorf("sync failed: %w", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	if err := os.Rename(part, path); err != nil {
+		return err
+	}
+	if Fsync == FsyncChunk {
+		return syncParent(path)
+	}
 	return nil
 }
+
+// VerifyChunks checks that all the chunks of a shard listed in metadata
+// are present in the download directory and have their remote size (see
+// ManifestChunks). The sizes that metadata does not record are asked to
+// the server.
+func VerifyChunks(rootDir string, shard int, metadata *Metadata) error {
+	if len(metadata.Sizes) != len(metadata.Chunks) {
+		sizes, err := RemoteChunkSizes(metadata)
+		if err != nil {
+			return fmt.Errorf("shard %d: getting the chunk sizes: %v", shard, err)
+		}
+		withSizes := *metadata
+		withSizes.Sizes = sizes
+		metadata = &withSizes
+	}
+	_, err := ManifestChunks(rootDir, shard, metadata)
+	return err
+}
+
+// ReadLocalMetadata returns the metadata.json saved by download in dir,
+// or an empty map if there is none (i.e. chunks were fetched by other means).
+// An empty map is also returned with the error, if the file is invalid.
+func ReadLocalMetadata(dir string) (map[int]*Metadata, error) {
+	path := filepath.Join(dir, "metadata.json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[int]*Metadata), nil
+	}
+	if err != nil {
+		return make(map[int]*Metadata), err
+	}
+	var shardMetadata map[int]*Metadata
+	if err := json.Unmarshal(data, &shardMetadata); err != nil {
+		return make(map[int]*Metadata), fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if err := ValidateShardMetadata(shardMetadata); err != nil {
+		return make(map[int]*Metadata), fmt.Errorf("%s: %v", path, err)
+	}
+	return shardMetadata, nil
+}
+
+// ChunkSize returns the remote size of a chunk, using a HEAD request.
+func ChunkSize(url string) (int64, error) {
+	resp, err := http.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("missing Content-Length in response for %s", url)
+	}
+	return resp.ContentLength, nil
+}
+
+// SnapshotSize returns the total compressed size of a snapshot, issuing
+// up to Concurrency parallel HEAD requests for its chunks.
+func SnapshotSize(metadata *Metadata) (int64, error) {
+	sizes, err := RemoteChunkSizes(metadata)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total, err
+}
+
+// RemoteChunkSizes returns the sizes of the chunks of a snapshot, in
+// order, issuing up to Concurrency parallel HEAD requests.
+func RemoteChunkSizes(metadata *Metadata) ([]int64, error) {
+	baseURL := fmt.Sprintf("%s/%s", EndpointURL, metadata.KeyBase)
+	chunks := make(chan int)
+	sizes := make([]int64, len(metadata.Chunks))
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chunks {
+				size, err := ChunkSize(fmt.Sprintf("%s/%s", baseURL, metadata.Chunks[i]))
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				sizes[i] = size
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range metadata.Chunks {
+		chunks <- i
+	}
+	close(chunks)
+	wg.Wait()
+	return sizes, firstErr
+}
@@ -0,0 +1,238 @@
+package downloader
+
+/*
+Durable writes.
+
+Files are written through the page cache, so after a power loss a
+file can have its final size and still hold zeros. Fsync says when
+snapdown waits for what it wrote to reach the disk:
+
+	never  when the system decides to write it
+	chunk  every downloaded chunk, and every file extracted by the
+	       native extractor, as soon as it is complete
+	end    the chunks of a shard once they are all downloaded, the
+	       extracted files once the shard is extracted
+
+Except with never, the files listed in an extraction checkpoint are
+synced before it is saved, so that a checkpoint never vouches for
+files that are not on disk.
+
+Chunks are downloaded to <chunk>.part, and renamed once complete.
+With end, shard-N.synced lists the chunks that were on disk before
+the download started: after a crash, the chunks that are not in it
+are downloaded again, whatever their size.
+
+Small files that describe the state of a run (metadata.json, the
+checkpoints, the indexes, the records of deleted chunks) are replaced
+with ReplaceFile, so that a crash leaves either the old or the new
+version. Directories are synced after renames, except with never.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FsyncPolicy says when written files are synced to disk.
+type FsyncPolicy int
+
+const (
+	FsyncNever FsyncPolicy = iota
+	FsyncChunk
+	FsyncEnd
+)
+
+var fsyncPolicyNames = []string{"never", "chunk", "end"}
+
+func (p FsyncPolicy) String() string {
+	return fsyncPolicyNames[p]
+}
+
+// ParseFsyncPolicy parses the value of --fsync.
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	for i, name := range fsyncPolicyNames {
+		if s == name {
+			return FsyncPolicy(i), nil
+		}
+	}
+	return FsyncNever, fmt.Errorf("unknown --fsync %q (expected never, chunk or end)", s)
+}
+
+// Fsync is the --fsync policy.
+var Fsync = FsyncNever
+
+// partSuffix is added to the name of a chunk while it is downloaded.
+const partSuffix = ".part"
+
+// ReplaceFile replaces the content of path with data, through a
+// temporary file and a rename.
+func ReplaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && Fsync != FsyncNever {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncParent(path)
+}
+
+// syncParent makes the creation, removal or renaming of path durable.
+func syncParent(path string) error {
+	if Fsync == FsyncNever {
+		return nil
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncFile waits for the content of the file at path to be on disk.
+func syncFile(path string) error {
+	f, err := openForSync(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// syncFiles syncs files, then the directories they are in.
+func syncFiles(files []string) error {
+	dirs := make(map[string]bool)
+	for _, path := range files {
+		if err := syncFile(path); err != nil {
+			return err
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncTree syncs the files and directories under dir, unless Fsync is
+// FsyncNever.
+func SyncTree(dir string) error {
+	if Fsync == FsyncNever {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case d.IsDir():
+			return syncDir(path)
+		case d.Type().IsRegular():
+			return syncFile(path)
+		}
+		return nil
+	})
+}
+
+// syncedChunks is the record of the chunks of a shard that were on disk
+// when a download with FsyncEnd started.
+type syncedChunks struct {
+	path  string
+	names map[string]bool // nil if there is no record
+}
+
+func syncedChunksPath(rootDir string, shard int) string {
+	return filepath.Join(rootDir, fmt.Sprintf("shard-%d.synced", shard))
+}
+
+// loadSyncedChunks reads the record left by a download that did not
+// finish. A record that can not be read trusts no chunk.
+func loadSyncedChunks(rootDir string, shard int) *syncedChunks {
+	s := &syncedChunks{path: syncedChunksPath(rootDir, shard)}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s
+	}
+	var names []string
+	json.Unmarshal(data, &names)
+	s.names = make(map[string]bool, len(names))
+	for _, name := range names {
+		s.names[name] = true
+	}
+	return s
+}
+
+// start records the chunks in dir before a download with FsyncEnd. If
+// there is a record already, the chunks downloaded since it was written
+// are not trusted either.
+func (s *syncedChunks) start(dir string) error {
+	if s.names != nil || Fsync != FsyncEnd {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	s.names = make(map[string]bool)
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), partSuffix) {
+			names = append(names, e.Name())
+			s.names[e.Name()] = true
+		}
+	}
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return ReplaceFile(s.path, data)
+}
+
+// trusted tells if a chunk that has its full size holds what was
+// downloaded.
+func (s *syncedChunks) trusted(chunk string) bool {
+	return s.names == nil || s.names[chunk]
+}
+
+// finish syncs the chunks of dir with FsyncEnd, then removes the record.
+func (s *syncedChunks) finish(dir string) error {
+	if Fsync == FsyncEnd {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var files []string
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), partSuffix) {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+		if err := syncFiles(files); err != nil {
+			return err
+		}
+	}
+	if s.names == nil {
+		return nil
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.names = nil
+	return syncParent(s.path)
+}
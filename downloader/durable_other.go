@@ -0,0 +1,15 @@
+//go:build !unix
+
+package downloader
+
+import "os"
+
+// Windows only flushes files opened for writing.
+func openForSync(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// Directories can not be synced here: the filesystem journals renames.
+func syncDir(dir string) error {
+	return nil
+}
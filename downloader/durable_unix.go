@@ -0,0 +1,23 @@
+//go:build unix
+
+package downloader
+
+import "os"
+
+func openForSync(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// syncDir makes the entries added to, removed from or renamed in dir
+// durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
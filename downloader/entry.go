@@ -0,0 +1,93 @@
+package downloader
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ShardRootOnly restricts the entries of a shard's archive to its
+// shard-<id>/ directory. Entries can never escape the output directory.
+var ShardRootOnly = true
+
+// EntryError is returned when an archive entry is refused.
+type EntryError struct {
+	Shard  int
+	Name   string
+	Reason string
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("shard %d: refusing archive entry %q: %s", e.Shard, e.Name, e.Reason)
+}
+
+// checkEntry is called for every entry of an archive, before it is
+// extracted, by all the extractors. Only regular files, directories and
+// links that stay in the shard's directory are accepted.
+func checkEntry(hdr *tar.Header, shardId int) error {
+	refuse := func(format string, args ...any) error {
+		return &EntryError{Shard: shardId, Name: hdr.Name, Reason: fmt.Sprintf(format, args...)}
+	}
+	if reason := checkEntryPath(hdr.Name, shardId); reason != "" {
+		return refuse("%s", reason)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir:
+	case tar.TypeSymlink:
+		// Without "..", a link can only point below its directory, even
+		// through other links. Checking where a link with ".." points
+		// would require resolving the links it goes through.
+		if path.IsAbs(hdr.Linkname) || hasDotDot(hdr.Linkname) {
+			return refuse("symlink to %q may point outside the archive", hdr.Linkname)
+		}
+	case tar.TypeLink:
+		if reason := checkEntryPath(hdr.Linkname, shardId); reason != "" {
+			return refuse("hardlink to %q: %s", hdr.Linkname, reason)
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		return refuse("device files are not allowed")
+	case tar.TypeFifo:
+		return refuse("FIFOs are not allowed")
+	default:
+		return refuse("unsupported entry type %q", hdr.Typeflag)
+	}
+	if hdr.Mode&(modeSetuid|modeSetgid) != 0 {
+		return refuse("setuid and setgid files are not allowed (mode %o)", hdr.Mode)
+	}
+	return nil
+}
+
+// Mode bits of tar headers
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+)
+
+// checkEntryPath returns why name can not be extracted, or "".
+func checkEntryPath(name string, shardId int) string {
+	switch {
+	case name == "":
+		return "empty path"
+	case path.IsAbs(name):
+		return "absolute path"
+	case hasDotDot(name):
+		return `path with ".."`
+	}
+	if ShardRootOnly {
+		root := fmt.Sprintf("shard-%d", shardId)
+		if clean := path.Clean(name); clean != root && !strings.HasPrefix(clean, root+"/") {
+			return fmt.Sprintf("outside %s/", root)
+		}
+	}
+	return ""
+}
+
+func hasDotDot(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
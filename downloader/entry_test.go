@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"archive/tar"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckEntry(t *testing.T) {
+	reg := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	}
+	link := func(typeflag byte, name, linkname string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: typeflag, Linkname: linkname, Mode: 0777}
+	}
+	withMode := func(hdr *tar.Header, mode int64) *tar.Header {
+		hdr.Mode = mode
+		return hdr
+	}
+	defer func() { ShardRootOnly = true }()
+	for _, c := range []struct {
+		name    string
+		hdr     *tar.Header
+		outside bool   // with ShardRootOnly = false
+		refused string // part of the reason, "" if accepted
+	}{
+		{"file", reg("shard-0/000001.sst"), false, ""},
+		{"directory", &tar.Header{Name: "shard-0/", Typeflag: tar.TypeDir, Mode: 0755}, false, ""},
+		{"shard directory", &tar.Header{Name: "shard-0", Typeflag: tar.TypeDir, Mode: 0755}, false, ""},
+		{"leading ./", reg("./shard-0/CURRENT"), false, ""},
+		{"dot dot, even inside the shard", reg("shard-0/a/../CURRENT"), false, `".."`},
+
+		{"empty path", reg(""), false, "empty path"},
+		{"absolute path", reg("/etc/passwd"), false, "absolute path"},
+		{"absolute path in the shard", reg("/shard-0/CURRENT"), false, "absolute path"},
+		{"dot dot", reg("../shard-0/CURRENT"), false, `".."`},
+		{"dot dot out of the shard", reg("shard-0/../../etc/passwd"), false, `".."`},
+		{"absolute path, outside allowed", reg("/etc/passwd"), true, "absolute path"},
+		{"dot dot, outside allowed", reg("../etc/passwd"), true, `".."`},
+
+		{"other shard", reg("shard-1/000001.sst"), false, "outside shard-0/"},
+		{"shard prefix", reg("shard-01/000001.sst"), false, "outside shard-0/"},
+		{"top level", reg("000001.sst"), false, "outside shard-0/"},
+		{"other shard, outside allowed", reg("shard-1/000001.sst"), true, ""},
+
+		{"symlink in the shard", link(tar.TypeSymlink, "shard-0/LATEST", "CURRENT"), false, ""},
+		{"symlink to a subdirectory", link(tar.TypeSymlink, "shard-0/latest", "archive/000001.sst"), false, ""},
+		{"symlink to an absolute path", link(tar.TypeSymlink, "shard-0/LATEST", "/etc/passwd"), false, "symlink"},
+		{"symlink with dot dot", link(tar.TypeSymlink, "shard-0/LATEST", "../shard-1/CURRENT"), false, "symlink"},
+		{"symlink escaping", link(tar.TypeSymlink, "shard-0/LATEST", "a/../../../etc"), false, "symlink"},
+		{"symlink to an absolute path, outside allowed", link(tar.TypeSymlink, "shard-0/LATEST", "/etc/passwd"), true, "symlink"},
+		{"symlink outside the shard", link(tar.TypeSymlink, "shard-1/LATEST", "CURRENT"), false, "outside shard-0/"},
+
+		{"hardlink in the shard", link(tar.TypeLink, "shard-0/000002.sst", "shard-0/000001.sst"), false, ""},
+		{"hardlink across shards", link(tar.TypeLink, "shard-0/000002.sst", "shard-1/000001.sst"), false, "hardlink"},
+		{"hardlink across shards, outside allowed", link(tar.TypeLink, "shard-0/000002.sst", "shard-1/000001.sst"), true, ""},
+		{"hardlink to an absolute path", link(tar.TypeLink, "shard-0/passwd", "/etc/passwd"), false, "hardlink"},
+		{"hardlink with dot dot", link(tar.TypeLink, "shard-0/passwd", "shard-0/../../etc/passwd"), true, "hardlink"},
+
+		{"char device", &tar.Header{Name: "shard-0/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}, false, "device"},
+		{"block device", &tar.Header{Name: "shard-0/sda", Typeflag: tar.TypeBlock, Devmajor: 8}, false, "device"},
+		{"fifo", &tar.Header{Name: "shard-0/fifo", Typeflag: tar.TypeFifo}, false, "FIFO"},
+		{"unsupported type", &tar.Header{Name: "shard-0/x", Typeflag: tar.TypeCont}, false, "unsupported"},
+
+		{"setuid", withMode(reg("shard-0/run"), 04755), false, "setuid"},
+		{"setgid", withMode(reg("shard-0/run"), 02755), false, "setuid"},
+		{"setgid directory", &tar.Header{Name: "shard-0/dir/", Typeflag: tar.TypeDir, Mode: 02755}, false, "setuid"},
+		{"sticky", withMode(reg("shard-0/run"), 01755), false, ""},
+	} {
+		ShardRootOnly = !c.outside
+		err := checkEntry(c.hdr, 0)
+		var entryErr *EntryError
+		switch {
+		case c.refused == "" && err != nil:
+			t.Errorf("%s: refused: %v", c.name, err)
+		case c.refused != "" && err == nil:
+			t.Errorf("%s: accepted", c.name)
+		case err == nil:
+		case !errors.As(err, &entryErr) || entryErr.Shard != 0 || entryErr.Name != c.hdr.Name:
+			t.Errorf("%s: got %#v, expected an EntryError for shard 0 and %q", c.name, err, c.hdr.Name)
+		case !strings.Contains(entryErr.Reason, c.refused):
+			t.Errorf("%s: got reason %q, expected %q in it", c.name, entryErr.Reason, c.refused)
+		}
+	}
+}
+
+func TestCheckEntryPath(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		shard   int
+		refused string
+	}{
+		{"shard-12/CURRENT", 12, ""},
+		{"shard-12", 12, ""},
+		{"shard-12/", 12, ""},
+		{"shard-12//CURRENT", 12, ""},
+		{"shard-1/CURRENT", 12, "outside shard-12/"},
+		{"shard-123/CURRENT", 12, "outside shard-12/"},
+		{"shard-12/..", 12, `".."`},
+		{"shard-12/..data", 12, ""},
+		{"/shard-12/CURRENT", 12, "absolute path"},
+		{"", 12, "empty path"},
+	} {
+		if got := checkEntryPath(c.name, c.shard); !strings.Contains(got, c.refused) || (c.refused == "") != (got == "") {
+			t.Errorf("%q in shard %d: got %q, expected %q", c.name, c.shard, got, c.refused)
+		}
+	}
+}
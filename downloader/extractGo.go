@@ -0,0 +1,382 @@
+package downloader
+
+/*
+Go-native extraction, for systems where tar is not available
+(distroless or scratch containers, for example).
+
+Decompression uses an external program (see decompress.go) if
+a faster one is installed, and inflate.go otherwise.
+
+It is organized as a pipeline, so that reading, decompressing
+and writing happen in parallel:
+
+	chunk files -> read-ahead -> gzip -> tar -> file writer
+
+*/
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	nativeBlockSize      = 1 << 20 // 1MB
+	nativeReadAheadDepth = 16      // blocks of compressed data read ahead
+	nativeWriteDepth     = 32      // blocks of extracted data waiting to be written
+)
+
+// NativeExtractor extracts chunks using archive/tar and inflate.go,
+// or an external decompressor if a faster one is available.
+type NativeExtractor struct {
+	// Decompressor is the --decompressor choice, "auto" by default.
+	Decompressor string
+}
+
+func (e NativeExtractor) Extract(src ChunkSource, dstDir string, shardId int, progressCh chan<- XUpdMsg) (ExtractResult, error) {
+	var (
+		result ExtractResult
+		ra     *readAhead
+	)
+	fail := func(err error) (ExtractResult, error) {
+		if ra != nil {
+			ra.Close() // result is updated by the read-ahead goroutine
+		}
+		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
+		return result, err
+	}
+
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return fail(err)
+	}
+	readAhead := func(r io.Reader) io.Reader {
+		ra = newReadAhead(r, nativeBlockSize, nativeReadAheadDepth)
+		return ra
+	}
+	stream, err := openTarStream(src, e.Decompressor, "go", dstDir, shardId, progressCh, &result, readAhead)
+	if err != nil {
+		return fail(err)
+	}
+	completed := false
+	defer func() { stream.release(completed) }()
+	defer ra.Close()
+
+	w := newFileWriter(dstDir, shardId, progressCh)
+	w.bytesOut = stream.resumed
+	w.checkpoints = stream.cp
+	tr := tar.NewReader(stream)
+	for {
+		offset := stream.nextEntry()
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			stream.entry(offset, hdr)
+			if stream.cp != nil {
+				err = w.send(writeOp{extracted: offset})
+			}
+		}
+		if err == nil {
+			err = w.entry(hdr, tr)
+		}
+		if err != nil {
+			abortReader(stream.ReadCloser)
+			w.Close()
+			return fail(err)
+		}
+	}
+	// Consume the end of the stream, so that gzip verifies its checksum
+	if err := stream.ReadCloser.Close(); err != nil {
+		w.Close()
+		return fail(err)
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+	ra.Close()
+	completed = true
+	result.BytesOut = w.bytesOut
+	result.Entries = stream.entries
+	return result, nil
+}
+
+// readAhead reads blocks from r in a separate goroutine, keeping up to
+// depth blocks ready to be consumed.
+type readAhead struct {
+	blocks   chan []byte
+	free     chan []byte
+	cur      []byte
+	last     []byte
+	err      error
+	done     chan struct{}
+	finished chan struct{}
+	once     sync.Once
+}
+
+func newReadAhead(r io.Reader, size, depth int) *readAhead {
+	ra := &readAhead{
+		blocks:   make(chan []byte, depth),
+		free:     make(chan []byte, depth+2),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	for i := 0; i < depth+2; i++ {
+		ra.free <- make([]byte, size)
+	}
+	go func() {
+		defer close(ra.finished)
+		defer close(ra.blocks)
+		for {
+			var buf []byte
+			select {
+			case buf = <-ra.free:
+			case <-ra.done:
+				return
+			}
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				select {
+				case ra.blocks <- buf[:n]:
+				case <-ra.done:
+					return
+				}
+			}
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			if err != nil {
+				ra.err = err
+				return
+			}
+		}
+	}()
+	return ra
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.last != nil {
+			ra.free <- ra.last[:cap(ra.last)]
+			ra.last = nil
+		}
+		b, ok := <-ra.blocks
+		if !ok {
+			return 0, ra.err
+		}
+		ra.cur, ra.last = b, b
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// Close stops the read-ahead goroutine and waits for it to exit.
+func (ra *readAhead) Close() error {
+	ra.once.Do(func() { close(ra.done) })
+	<-ra.finished
+	return nil
+}
+
+// writeOp is a unit of work for fileWriter. The first op of an entry
+// carries its header, regular files are followed by data ops.
+// An op with extracted set tells where the next entry starts in
+// the tar stream, to save checkpoints.
+type writeOp struct {
+	hdr       *tar.Header
+	data      []byte
+	last      bool
+	extracted int64
+}
+
+// fileWriter writes tar entries to disk in its own goroutine.
+type fileWriter struct {
+	dstDir     string
+	shardId    int
+	progressCh chan<- XUpdMsg
+	ops        chan writeOp
+	pool       sync.Pool
+	failed     chan struct{}
+	finished   chan struct{}
+	err        error
+	bytesOut   int64
+	// checkpoints is set if the extraction is resumable
+	checkpoints *checkpointer
+
+	// owned by the writer goroutine
+	file outputFile
+	hdr  *tar.Header
+	path string
+}
+
+func newFileWriter(dstDir string, shardId int, progressCh chan<- XUpdMsg) *fileWriter {
+	w := &fileWriter{
+		dstDir:     dstDir,
+		shardId:    shardId,
+		progressCh: progressCh,
+		ops:        make(chan writeOp, nativeWriteDepth),
+		failed:     make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	w.pool.New = func() any { return make([]byte, nativeBlockSize) }
+	go w.run()
+	return w
+}
+
+// entry queues a tar entry (and its contents, read from r) for writing.
+func (w *fileWriter) entry(hdr *tar.Header, r io.Reader) error {
+	if err := checkEntry(hdr, w.shardId); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return w.send(writeOp{hdr: hdr, last: true})
+	}
+	if err := w.send(writeOp{hdr: hdr, last: hdr.Size == 0}); err != nil {
+		return err
+	}
+	for remaining := hdr.Size; remaining > 0; {
+		buf := w.pool.Get().([]byte)
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), remaining)])
+		if err != nil {
+			return err
+		}
+		remaining -= int64(n)
+		if err := w.send(writeOp{data: buf[:n], last: remaining == 0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *fileWriter) send(op writeOp) error {
+	select {
+	case w.ops <- op:
+		return nil
+	case <-w.failed:
+		return w.err
+	}
+}
+
+// Close waits for all queued entries to be written.
+func (w *fileWriter) Close() error {
+	close(w.ops)
+	<-w.finished
+	return w.err
+}
+
+func (w *fileWriter) run() {
+	defer close(w.finished)
+	for op := range w.ops {
+		if w.err != nil {
+			continue // drain
+		}
+		if err := w.apply(op); err != nil {
+			w.err = err
+			close(w.failed)
+		}
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+func (w *fileWriter) apply(op writeOp) error {
+	if op.extracted > 0 {
+		w.checkpoints.extracted(op.extracted)
+		return nil
+	}
+	if op.hdr != nil {
+		path, err := w.target(op.hdr.Name)
+		if err != nil {
+			return err
+		}
+		w.hdr, w.path = op.hdr, path
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if op.data != nil {
+		_, err := w.file.Write(op.data)
+		w.pool.Put(op.data[:cap(op.data)])
+		if err != nil {
+			return err
+		}
+	}
+	if op.last {
+		return w.finish()
+	}
+	return nil
+}
+
+// target returns the path an entry is extracted to, refusing, like
+// tar does by default, entries that would end up outside dstDir.
+func (w *fileWriter) target(name string) (string, error) {
+	path := filepath.Join(w.dstDir, name)
+	rel, err := filepath.Rel(w.dstDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract %q outside %s", name, w.dstDir)
+	}
+	return path, nil
+}
+
+func (w *fileWriter) start() error {
+	hdr := w.hdr
+	mode := hdr.FileInfo().Mode().Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(w.path, mode|0700)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(w.path), os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		w.file = writeCache(f)
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(w.path), os.ModePerm); err != nil {
+			return err
+		}
+		os.Remove(w.path)
+		return os.Symlink(hdr.Linkname, w.path)
+	case tar.TypeLink:
+		target, err := w.target(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		os.Remove(w.path)
+		return os.Link(target, w.path)
+	}
+	// Other entry types are refused by checkEntry.
+	return nil
+}
+
+func (w *fileWriter) finish() error {
+	if w.file == nil {
+		return nil
+	}
+	var err error
+	if Fsync == FsyncChunk {
+		err = w.file.Sync()
+	}
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	os.Chtimes(w.path, w.hdr.ModTime, w.hdr.ModTime)
+	w.bytesOut += w.hdr.Size
+	w.progressCh <- XUpdMsg{
+		Shard:      w.shardId,
+		TotalBytes: w.bytesOut,
+		File:       w.path,
+	}
+	return nil
+}
@@ -3,82 +3,117 @@ package downloader
 /*
 OK, This file may seem strage, because it actually uses tar
 to extract files. It turns out that using tar is ~30% faster
-than my Go-native implementation. Totally worth the hack.
+than the Go-native implementation (see extractGo.go). Totally
+worth the hack, when tar is available.
 */
 
 import (
+	"archive/tar"
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
+	"syscall"
 )
 
 type XUpdMsg struct {
-	Shard      int
+	Shard      int // -1 for messages about the whole run
 	Idx        int
 	Total      int
 	File       string
 	TotalBytes int64
 	Error      error
+	Info       string // something worth telling the user, like a resumed extraction
+	Warning    string // a problem that does not stop the extraction
+	Done       bool   // the shard has been extracted
 	Quit       bool
 }
 
-func ExtractWithNativeTar(rootSrcDir, dstDir string, shardId int, progressCh chan<- XUpdMsg) {
-	srcDir := filepath.Join(rootSrcDir, fmt.Sprintf("shard-%d", shardId))
-	entries, err := os.ReadDir(srcDir)
+// ExtractResult summarizes a shard extraction.
+type ExtractResult struct {
+	Chunks   int
+	BytesIn  int64
+	BytesOut int64
+	// Entries are the names of the archive's entries, relative to the
+	// output dir. Directories that precede the point an extraction
+	// resumed from are missing.
+	Entries []string
+}
+
+// TarExtractor pipes the chunks into the system's tar.
+type TarExtractor struct {
+	// Decompressor is the --decompressor choice, "auto" by default.
+	Decompressor string
+	// Tar is the tar to run, "tar" in PATH if nil.
+	Tar *TarBinary
+	// Args are added to the arguments of tar.
+	Args []string
+}
+
+// ExtractWithNativeTar extracts the downloaded chunks of a shard into
+// dstDir using tar, with the default decompressor.
+func ExtractWithNativeTar(rootSrcDir, dstDir string, shardId int, progressCh chan<- XUpdMsg) (ExtractResult, error) {
+	src, err := DirChunks(rootSrcDir, shardId)
 	if err != nil {
-		progressCh <- XUpdMsg{
-			Shard: shardId,
-			Error: err,
-			Quit:  true,
-		}
-		return
+		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
+		return ExtractResult{}, err
 	}
+	return TarExtractor{}.Extract(src, dstDir, shardId, progressCh)
+}
 
-	// Preallocate fileNames slice and use append-less assignment for better efficiency
-	fileNames := make([]string, 0, len(entries))
-	for _, f := range entries {
-		if f.Type().IsRegular() {
-			fileNames = append(fileNames, filepath.Join(srcDir, f.Name()))
-		}
+func (e TarExtractor) Extract(src ChunkSource, dstDir string, shardId int, progressCh chan<- XUpdMsg) (ExtractResult, error) {
+	var result ExtractResult
+
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
+		return result, err
 	}
-	sort.Strings(fileNames)
-	if len(fileNames) == 0 {
-		progressCh <- XUpdMsg{
-			Shard: shardId,
-			Error: fmt.Errorf("no files to extract"),
-			Quit:  true,
+	tarBin := e.Tar
+	if tarBin == nil {
+		var err error
+		if tarBin, err = DetectTar(""); err != nil {
+			progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
+			return result, err
 		}
-		return
 	}
-
-	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
-		return
+	// tar would call gzip anyway, so it is our fallback, unless the
+	// extraction has to be resumable
+	fallback := "go"
+	if _, err := exec.LookPath("gzip"); err == nil {
+		fallback = "gzip"
+	}
+	stream, err := openTarStream(src, e.Decompressor, fallback, dstDir, shardId, progressCh, &result, func(r io.Reader) io.Reader { return r })
+	if err != nil {
+		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
+		return result, err
 	}
-	cmd := exec.Command("tar", "xzvf", "-", "-C", dstDir)
+	completed := false
+	defer func() { stream.release(completed) }()
+
+	progressCh <- XUpdMsg{Shard: shardId, Info: "extracting with " + tarBin.String()}
+	cmd := exec.Command(tarBin.Path, tarBin.extractArgs(dstDir, e.Args)...)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
-		return
+		return result, err
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
-		return
+		return result, err
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		progressCh <- XUpdMsg{Shard: shardId, Error: err, Quit: true}
-		return
+		return result, err
 	}
 
 	if err := cmd.Start(); err != nil {
@@ -87,122 +122,294 @@ func ExtractWithNativeTar(rootSrcDir, dstDir string, shardId int, progressCh cha
 			Error: err,
 			Quit:  true,
 		}
-		return
+		return result, err
 	}
 
+	result.BytesOut = stream.resumed
+	output := newTarOutput(tarBin, dstDir, shardId, progressCh, result.BytesOut)
 	var wg sync.WaitGroup
 	wg.Add(3)
-	go trackTarOutput(stdout, dstDir, shardId, progressCh, &wg)
-	go trackTarOutput(stderr, dstDir, shardId, progressCh, &wg)
+	go func() {
+		defer wg.Done()
+		output.scanListing(stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		output.scanStderr(stderr)
+	}()
 
-	// Stream input files into tar's stdin
+	// Stream the decompressed chunks into tar's stdin
+	var feedErr error
 	go func() {
 		defer wg.Done()
 		defer stdin.Close()
-		buf := make([]byte, 1<<20) // Use a 1MB buffer for efficient file copy
-		for i, filePath := range fileNames {
-			file, err := os.Open(filePath)
-			if err != nil {
-				progressCh <- XUpdMsg{
-					Shard: shardId,
-					Error: err,
-				}
-				return
-			}
-			_, err = io.CopyBuffer(stdin, file, buf)
-			file.Close()
-			if err != nil {
-				progressCh <- XUpdMsg{
-					Shard: shardId,
-					Error: err,
-				}
-				return
-			}
-
-			// Track input file progress here
-			progressCh <- XUpdMsg{
-				Total: len(fileNames),
-				Shard: shardId,
-				Idx:   i + 1, // Input file index
-				//File:  filePath,
-			}
+		err := feedTar(stdin, stream, shardId)
+		if err == nil {
+			err = stream.ReadCloser.Close()
+		} else {
+			abortReader(stream.ReadCloser)
 		}
+		feedErr = err
 	}()
 
 	// Wait for background goroutines to finish and then cmd.Wait
 	wg.Wait()
-	if err := cmd.Wait(); err != nil {
-		progressCh <- XUpdMsg{
-			Shard: shardId,
-			Error: err,
-			Quit:  true,
+	result.BytesOut = output.close()
+	tarErr := output.result(cmd.Wait())
+
+	// tar stops reading when it fails, so the failure to write to
+	// its stdin is only a consequence.
+	if feedErr != nil && !(tarErr != nil && errors.Is(feedErr, syscall.EPIPE)) {
+		progressCh <- XUpdMsg{Shard: shardId, Error: feedErr}
+	}
+	if tarErr != nil {
+		progressCh <- XUpdMsg{Shard: shardId, Error: tarErr, Quit: true}
+		return result, tarErr
+	}
+	completed = feedErr == nil
+	result.Entries = stream.entries
+	return result, feedErr
+}
+
+// feedTar copies the tar stream to tar's stdin. Every entry is parsed
+// and checked before tar gets it, and recorded, to save checkpoints as
+// tar goes and index the entries.
+func feedTar(stdin io.Writer, stream *tarStream, shardId int) error {
+	buf := make([]byte, 1<<20) // Use a 1MB buffer for efficient file copy
+	gate := &entryGate{w: stdin, stream: stream}
+	tr := tar.NewReader(io.TeeReader(stream, gate))
+	for {
+		offset := stream.nextEntry()
+		gate.hold = true
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkEntry(hdr, shardId); err != nil {
+			return err
+		}
+		stream.entry(offset, hdr)
+		if err := gate.release(); err != nil {
+			return err
+		}
+		for {
+			_, err := tr.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
 		}
-		return
 	}
+	// The end of the archive, and the padding after it
+	if err := gate.release(); err != nil {
+		return err
+	}
+	_, err := io.CopyBuffer(gate, stream, buf)
+	return err
 }
 
-func trackTarOutput(r io.ReadCloser, dstDir string, shardId int, progressCh chan<- XUpdMsg, wg *sync.WaitGroup) {
-	defer wg.Done()
-	defer r.Close()
-	scanner := bufio.NewScanner(r)
-	var (
-		lastFilePath      string
-		totalBytesWritten int64 = 0
-	)
+// entryGate writes to tar what tar.Reader reads from the stream, but
+// holds the headers of an entry until the entry has been checked.
+type entryGate struct {
+	w      io.Writer
+	stream *tarStream
+	hold   bool
+	held   []byte
+}
 
+func (g *entryGate) Write(p []byte) (int, error) {
+	if g.hold {
+		g.held = append(g.held, p...)
+		return len(p), nil
+	}
+	return g.write(p)
+}
+
+func (g *entryGate) write(p []byte) (int, error) {
+	n, err := g.w.Write(p)
+	if err == nil && g.stream.cp != nil {
+		g.stream.cp.extracted(g.stream.pos - tarPipeSlack)
+	}
+	return n, err
+}
+
+// release writes the held headers, and stops holding.
+func (g *entryGate) release() error {
+	g.hold = false
+	_, err := g.write(g.held)
+	g.held = g.held[:0]
+	return err
+}
+
+// TarError is returned when tar exits with an error.
+type TarError struct {
+	ExitStatus int
+	// Messages are the errors printed by tar.
+	Messages []string
+}
+
+func (e *TarError) Error() string {
+	const maxMessages = 5
+	msg := fmt.Sprintf("tar exited with status %d", e.ExitStatus)
+	if len(e.Messages) == 0 {
+		return msg
+	}
+	messages := e.Messages
+	if len(messages) > maxMessages {
+		messages = append(messages[:maxMessages:maxMessages], fmt.Sprintf("and %d more", len(e.Messages)-maxMessages))
+	}
+	return msg + ": " + strings.Join(messages, "; ")
+}
+
+// tarWarnings are parts of the messages tar prints about problems that
+// do not stop the extraction.
+var tarWarnings = []string{
+	"Removing leading",
+	"in the future",
+	"implausibly old time stamp",
+	"Ignoring unknown extended header keyword",
+	"A lone zero block",
+	"Failed to set default locale",
+}
+
+// tarOutput follows what tar prints: the files it extracts (one per
+// line, prefixed with "x " by bsdtar which lists them on stderr), and
+// its warnings and errors on stderr.
+type tarOutput struct {
+	tar        *TarBinary
+	dstDir     string
+	shardId    int
+	progressCh chan<- XUpdMsg
+	files      chan string
+	tracked    chan int64 // the total, once files is closed
+
+	mu     sync.Mutex
+	errors []string
+}
+
+func newTarOutput(tarBin *TarBinary, dstDir string, shardId int, progressCh chan<- XUpdMsg, total int64) *tarOutput {
+	o := &tarOutput{
+		tar:        tarBin,
+		dstDir:     dstDir,
+		shardId:    shardId,
+		progressCh: progressCh,
+		files:      make(chan string, 100),
+		tracked:    make(chan int64, 1),
+	}
+	go o.track(total)
+	return o
+}
+
+// scanListing reads tar's stdout.
+func (o *tarOutput) scanListing(r io.Reader) {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
-		var fileName string
-		if strings.HasPrefix(line, "x ") {
-			fileName = strings.TrimPrefix(line, "x ")
-		} else {
-			fileName = line
+		if o.tar.listsOnStderr() {
+			line = strings.TrimPrefix(line, "x ")
 		}
-		fullPath := filepath.Join(dstDir, fileName)
-
-		// Report previous file size now (because it's done)
-		if lastFilePath != "" {
-			fileInfo, err := os.Lstat(lastFilePath)
-			var size int64 = 0
-			if err == nil && fileInfo.Mode().IsRegular() {
-				size = fileInfo.Size()
-			}
-
-			totalBytesWritten += size
+		if line != "" {
+			o.files <- line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		o.progressCh <- XUpdMsg{Shard: o.shardId, Error: err}
+	}
+}
 
-			// Send update message for the completed file
-			progressCh <- XUpdMsg{
-				Shard:      shardId,
-				TotalBytes: totalBytesWritten,
-				File:       lastFilePath,
-			}
+// scanStderr reads tar's stderr. Warnings are reported as they come,
+// errors are reported with tar's exit status by result.
+func (o *tarOutput) scanStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case o.tar.listsOnStderr() && strings.HasPrefix(line, "x "):
+			o.files <- strings.TrimPrefix(line, "x ")
+		case strings.Contains(line, "Exiting with failure status"):
+			// GNU tar's summary of the previous errors
+		case strings.HasPrefix(line, "Total bytes read"):
+			// GNU tar's --totals
+			o.progressCh <- XUpdMsg{Shard: o.shardId, Info: "tar: " + line}
+		case isTarWarning(line):
+			o.progressCh <- XUpdMsg{Shard: o.shardId, Warning: line}
+		default:
+			o.mu.Lock()
+			o.errors = append(o.errors, line)
+			o.mu.Unlock()
 		}
+	}
+	if err := scanner.Err(); err != nil {
+		o.progressCh <- XUpdMsg{Shard: o.shardId, Error: err}
+	}
+}
 
-		// Track current file for the next iteration
-		lastFilePath = fullPath
+func isTarWarning(line string) bool {
+	for _, w := range tarWarnings {
+		if strings.Contains(line, w) {
+			return true
+		}
 	}
+	return false
+}
 
-	// After loop ends, report the final file (it doesn't have a "next" file to trigger it)
-	if lastFilePath != "" {
+// track reports the files extracted by tar. A file is reported once
+// tar lists the next one, or stops, so that its size is final.
+func (o *tarOutput) track(total int64) {
+	var lastFilePath string
+	report := func() {
 		fileInfo, err := os.Lstat(lastFilePath)
-		var size int64 = 0
 		if err == nil && fileInfo.Mode().IsRegular() {
-			size = fileInfo.Size()
+			total += fileInfo.Size()
+			if LowCache {
+				dropFileCache(lastFilePath)
+			}
 		}
-
-		totalBytesWritten += size
-
-		progressCh <- XUpdMsg{
-			Shard:      shardId,
-			TotalBytes: totalBytesWritten,
+		o.progressCh <- XUpdMsg{
+			Shard:      o.shardId,
+			TotalBytes: total,
 			File:       lastFilePath,
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		progressCh <- XUpdMsg{
-			Shard: shardId,
-			Error: err,
+	for fileName := range o.files {
+		if lastFilePath != "" {
+			report()
 		}
+		lastFilePath = filepath.Join(o.dstDir, fileName)
+	}
+	if lastFilePath != "" {
+		report()
+	}
+	o.tracked <- total
+}
+
+// close is called once tar's output has been read, and returns the
+// total size of the extracted files.
+func (o *tarOutput) close() int64 {
+	close(o.files)
+	return <-o.tracked
+}
+
+// result returns the error of tar, given the result of cmd.Wait. The
+// messages tar printed when it did not fail are reported as warnings.
+func (o *tarOutput) result(waitErr error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		return &TarError{ExitStatus: exitErr.ExitCode(), Messages: o.errors}
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	for _, line := range o.errors {
+		o.progressCh <- XUpdMsg{Shard: o.shardId, Warning: line}
 	}
+	return nil
 }
@@ -0,0 +1,490 @@
+package downloader
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Extractor extracts the chunks of a shard into dstDir.
+// Progress and errors are reported to progressCh, the returned error
+// is nil only if the extraction completed successfully.
+type Extractor interface {
+	Extract(src ChunkSource, dstDir string, shardId int, progressCh chan<- XUpdMsg) (ExtractResult, error)
+}
+
+// ChunkSource provides the chunks of a shard's archive, in order.
+type ChunkSource interface {
+	Len() int
+	// Open returns chunk i, waiting for it to become available if needed.
+	Open(i int) (io.ReadCloser, error)
+}
+
+// TarOptions selects the tar used by TarExtractor.
+type TarOptions struct {
+	Path string   // "tar" in PATH if empty
+	Args []string // extra arguments for tar
+}
+
+// NewExtractor returns the extractor called name: "tar", "native", or
+// "auto" which uses tar when a usable one is found and falls back to
+// native. decompressor is passed to ChooseDecompressor for every shard.
+func NewExtractor(name, decompressor string, tarOpts TarOptions) (Extractor, error) {
+	if decompressor != "" && decompressor != "auto" {
+		if _, ok := decompressorFormats[decompressor]; !ok {
+			return nil, fmt.Errorf("unknown decompressor %q", decompressor)
+		}
+	}
+	switch name {
+	case "auto", "":
+		tarBin, err := DetectTar(tarOpts.Path)
+		if err == nil {
+			return TarExtractor{Decompressor: decompressor, Tar: tarBin, Args: tarOpts.Args}, nil
+		}
+		if tarOpts.Path != "" {
+			return nil, err // the user asked for this tar
+		}
+		return NativeExtractor{Decompressor: decompressor}, nil
+	case "tar":
+		tarBin, err := DetectTar(tarOpts.Path)
+		if err != nil {
+			return nil, err
+		}
+		return TarExtractor{Decompressor: decompressor, Tar: tarBin, Args: tarOpts.Args}, nil
+	case "native":
+		return NativeExtractor{Decompressor: decompressor}, nil
+	}
+	return nil, fmt.Errorf("unknown extractor %q (expected auto, tar or native)", name)
+}
+
+// DirChunks returns the chunks of a shard in its download directory.
+// If rootSrcDir has a metadata.json listing the shard (see download), its
+// chunks are used, in order, and other files are ignored. Otherwise, all
+// the files of the directory are used, sorted by name, except chunks
+// that are being downloaded.
+func DirChunks(rootSrcDir string, shardId int) (ChunkSource, error) {
+	shardMetadata, err := ReadLocalMetadata(rootSrcDir)
+	if err != nil {
+		return nil, err
+	}
+	if metadata := shardMetadata[shardId]; metadata != nil {
+		return ManifestChunks(rootSrcDir, shardId, metadata)
+	}
+
+	srcDir := filepath.Join(rootSrcDir, fmt.Sprintf("shard-%d", shardId))
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := loadDeletions(rootSrcDir, shardId)
+	fileNames := make([]string, 0, len(entries))
+	for _, f := range entries {
+		if _, ok := deleted.size(f.Name()); f.Type().IsRegular() && !ok && !strings.HasSuffix(f.Name(), partSuffix) {
+			fileNames = append(fileNames, filepath.Join(srcDir, f.Name()))
+		}
+	}
+	for _, name := range deleted.names() {
+		fileNames = append(fileNames, filepath.Join(srcDir, name))
+	}
+	sort.Strings(fileNames)
+	if len(fileNames) == 0 {
+		return nil, fmt.Errorf("no files to extract")
+	}
+	return &fileChunks{files: fileNames, index: IndexPath(rootSrcDir, shardId), dels: deleted}, nil
+}
+
+// ManifestChunks returns the chunks listed in metadata, in order, after
+// checking that they are all in the shard's download directory and
+// complete: that they have the sizes recorded in metadata. Without
+// recorded sizes (metadata.json written by an older version), a chunk is
+// only known to be incomplete if it is shorter than the others, as all
+// chunks have the same size, except the last one.
+func ManifestChunks(rootSrcDir string, shardId int, metadata *Metadata) (ChunkSource, error) {
+	if len(metadata.Chunks) == 0 {
+		return nil, fmt.Errorf("shard %d: no chunks listed in the metadata", shardId)
+	}
+	srcDir := filepath.Join(rootSrcDir, fmt.Sprintf("shard-%d", shardId))
+	deleted := loadDeletions(rootSrcDir, shardId)
+	files := make([]string, len(metadata.Chunks))
+	sizes := make([]int64, len(metadata.Chunks))
+	var missing []string
+	var chunkSize int64
+	for i, chunk := range metadata.Chunks {
+		files[i] = filepath.Join(srcDir, chunk)
+		if size, ok := deleted.size(chunk); ok {
+			sizes[i] = size
+			chunkSize = max(chunkSize, size)
+			continue
+		}
+		info, err := os.Stat(files[i])
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			missing = append(missing, chunk)
+			continue
+		}
+		sizes[i] = info.Size()
+		chunkSize = max(chunkSize, info.Size())
+	}
+	var partial []string
+	for i, chunk := range metadata.Chunks {
+		expected, last := chunkSize, i == len(metadata.Chunks)-1
+		if len(metadata.Sizes) == len(metadata.Chunks) {
+			expected, last = metadata.Sizes[i], false
+		}
+		if sizes[i] > 0 && sizes[i] != expected && !(last && sizes[i] < expected) {
+			partial = append(partial, fmt.Sprintf("%s (%d of %d bytes)", chunk, sizes[i], expected))
+		}
+	}
+	if len(missing) > 0 || len(partial) > 0 {
+		var problems []string
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%d of %d chunks missing or empty: %s", len(missing), len(metadata.Chunks), strings.Join(missing, ", ")))
+		}
+		if len(partial) > 0 {
+			problems = append(problems, fmt.Sprintf("%d of %d chunks incomplete or of the wrong size: %s", len(partial), len(metadata.Chunks), strings.Join(partial, ", ")))
+		}
+		return nil, fmt.Errorf("shard %d: %s in %s", shardId, strings.Join(problems, "; "), srcDir)
+	}
+	return &fileChunks{files: files, index: IndexPath(rootSrcDir, shardId), dels: deleted}, nil
+}
+
+// fileChunks is a ChunkSource of files that are already on disk.
+type fileChunks struct {
+	files []string
+	index string
+	dels  *deletions
+}
+
+func (f *fileChunks) Len() int {
+	return len(f.files)
+}
+
+func (f *fileChunks) Open(i int) (io.ReadCloser, error) {
+	return f.dels.open(f.files[i])
+}
+
+func (f *fileChunks) chunkPath(i int) string {
+	return f.files[i]
+}
+
+func (f *fileChunks) deleted() *deletions {
+	return f.dels
+}
+
+func (f *fileChunks) IndexPath() string {
+	return f.index
+}
+
+// tarStream is the decompressed tar stream of a shard.
+type tarStream struct {
+	io.ReadCloser
+	chunks *chunkReader
+	// cp records checkpoints, it is nil if the stream is not resumable.
+	cp *checkpointer
+	// index is nil if the archive can not be indexed while it is extracted.
+	index *indexWriter
+	// pos is the offset of the next byte in the tar stream, which
+	// does not start at 0 when the extraction is resumed.
+	pos int64
+	// resumed is the size of the files extracted before the
+	// extraction was resumed.
+	resumed int64
+	// entries are the names of the entries, see ExtractResult.
+	entries []string
+}
+
+func (s *tarStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+// nextEntry returns where the next tar entry starts, once the current
+// entry has been read up to the end of its data.
+func (s *tarStream) nextEntry() int64 {
+	return (s.pos + 511) &^ 511
+}
+
+// entry records a tar entry, that starts at offset.
+func (s *tarStream) entry(offset int64, hdr *tar.Header) {
+	s.entries = append(s.entries, hdr.Name)
+	if s.cp != nil {
+		s.cp.entry(offset, hdr)
+	}
+	if s.index != nil {
+		s.index.entry(offset, hdr)
+	}
+}
+
+// release releases the chunks. If the extraction completed, the
+// checkpoint is removed and the index is saved.
+func (s *tarStream) release(completed bool) {
+	s.chunks.Close()
+	if s.index != nil {
+		if completed {
+			s.index.commit()
+		} else {
+			s.index.abort()
+		}
+	}
+	if s.cp != nil && completed {
+		s.cp.done()
+	}
+}
+
+// openTarStream opens the archive of a shard for extraction in dstDir,
+// and applies wrap to the compressed stream.
+//
+// Gzip archives are read by the "go" decompressor, unless an accelerated
+// one is available, or fallback is another one. The "go" decompressor is
+// used anyway with a checkpoint to resume from, or chunks to delete as
+// they are read. The extraction is then resumable: it resumes from the
+// checkpoint left by an interrupted one, if there is a valid one.
+// An index is saved next to the chunks, if they are saved on disk, and
+// the archive is read by the "go" decompressor or is not compressed.
+func openTarStream(src ChunkSource, decompressor, fallback, dstDir string, shardId int, progressCh chan<- XUpdMsg, result *ExtractResult, wrap func(io.Reader) io.Reader) (*tarStream, error) {
+	chunks, archive, d, err := openShardStream(src, decompressor, fallback, shardId, progressCh, result)
+	if err != nil {
+		return nil, err
+	}
+	// The speed of an accelerated decompressor is not worth starting over,
+	// and chunks can only be deleted as they are read if it is resumable.
+	files, deletable := src.(chunkFiles)
+	deletable = deletable && DeleteConsumedChunks
+	if (decompressor == "" || decompressor == "auto") && decompressorFormats[d.Name] == FormatGzip && (hasCheckpoint(dstDir, shardId) || deletable) {
+		d = Decompressor{Name: "go"}
+	}
+	header, _ := archive.Peek(512)
+	head := crc32.ChecksumIEEE(header)
+
+	var saved *shardCheckpoint
+	s := &tarStream{chunks: chunks}
+	if d.Name == "go" {
+		s.cp = &checkpointer{path: checkpointPath(dstDir, shardId), head: head, dir: dstDir}
+		saved, err = loadCheckpoint(s.cp.path, dstDir, head)
+		if err != nil {
+			progressCh <- XUpdMsg{Shard: shardId, Info: fmt.Sprintf("starting over: %v", err)}
+		}
+		if deletable {
+			deleter, err := newChunkDeleter(files, func(info string) {
+				progressCh <- XUpdMsg{Shard: shardId, Info: info}
+			})
+			if err != nil {
+				chunks.Close()
+				return nil, err
+			}
+			s.cp.onSave = deleter.saved
+		}
+	} else if deletable {
+		progressCh <- XUpdMsg{Shard: shardId, Info: fmt.Sprintf("chunks will be deleted once the shard is extracted, extractions with %s can not be resumed", d.Name)}
+	}
+	if indexed, ok := src.(indexedSource); ok && saved == nil && (d.Name == "go" || d.Name == "none") {
+		// Without an index, only extracting the whole shard is slower
+		s.index, _ = newIndexWriter(indexed.IndexPath(), decompressorFormats[d.Name], head)
+	}
+
+	if saved == nil {
+		prefetch(src)
+	}
+	switch {
+	case d.Name != "go":
+		if s.ReadCloser, err = d.Reader(wrap(archive)); err != nil {
+			s.release(false)
+			return nil, err
+		}
+		return s, nil
+	case saved == nil:
+		f := newInflater(wrap(archive))
+		s.ReadCloser = f
+		f.checkpoint, f.every = s.checkpoint, indexEvery
+		return s, nil
+	}
+
+	chunks.Close()
+	*result = ExtractResult{}
+	if s.chunks, err = newChunkReaderAt(src, saved.Gzip.In, shardId, progressCh, result); err != nil {
+		return nil, err
+	}
+	f := newInflaterAt(wrap(s.chunks), saved.Gzip)
+	f.checkpoint, f.every = s.checkpoint, indexEvery
+	if _, err := io.CopyN(io.Discard, f, saved.Entry-saved.Gzip.Out); err != nil {
+		s.chunks.Close()
+		return nil, err
+	}
+	s.ReadCloser, s.pos = f, saved.Entry
+	s.cp.files, s.cp.saved = saved.Files, saved.Gzip.Out
+	for _, file := range saved.Files {
+		s.resumed += file.Size
+		s.entries = append(s.entries, file.Name)
+	}
+	progressCh <- XUpdMsg{Shard: shardId, Info: fmt.Sprintf("resuming after %d files (%d bytes) already extracted", len(saved.Files), s.resumed)}
+	return s, nil
+}
+
+// checkpoint is called by the decompressor.
+func (s *tarStream) checkpoint(cp gzipCheckpoint) {
+	s.cp.candidate(cp)
+	if s.index != nil {
+		s.index.checkpoint(cp)
+	}
+}
+
+// openShardStream returns the archive stream of a shard, and the
+// decompressor to use for it, based on the stream's magic bytes.
+func openShardStream(src ChunkSource, decompressor, fallback string, shardId int, progressCh chan<- XUpdMsg, result *ExtractResult) (*chunkReader, *bufio.Reader, Decompressor, error) {
+	chunks := newChunkReader(src, shardId, progressCh, result)
+	stream := bufio.NewReaderSize(chunks, 1<<20)
+	header, err := stream.Peek(512)
+	if err != nil && err != io.EOF {
+		chunks.Close()
+		return nil, nil, Decompressor{}, err
+	}
+	format, err := formatOf(header)
+	if err == nil {
+		var d Decompressor
+		if d, err = ChooseDecompressor(decompressor, format, fallback); err == nil {
+			return chunks, stream, d, nil
+		}
+	}
+	chunks.Close()
+	return nil, nil, Decompressor{}, err
+}
+
+// chunkReader reads the chunks of a ChunkSource as a single stream,
+// and reports progress every time a chunk has been read completely,
+// unless progressCh is nil.
+type chunkReader struct {
+	src        ChunkSource
+	idx        int
+	current    io.ReadCloser
+	shardId    int
+	progressCh chan<- XUpdMsg
+	result     *ExtractResult
+}
+
+func newChunkReader(src ChunkSource, shardId int, progressCh chan<- XUpdMsg, result *ExtractResult) *chunkReader {
+	return &chunkReader{src: src, shardId: shardId, progressCh: progressCh, result: result}
+}
+
+// chunkSizer is implemented by the chunk sources that can tell the size
+// of a chunk without reading it, so that resuming an extraction does not
+// read the chunks before the checkpoint.
+type chunkSizer interface {
+	ChunkSize(i int) (int64, error)
+}
+
+// prefetcher is implemented by the chunk sources that only read ahead
+// once told that the stream goes on from the start.
+type prefetcher interface {
+	Prefetch()
+}
+
+// prefetch lets src read ahead, when the stream is read from the start.
+func prefetch(src ChunkSource) {
+	if p, ok := src.(prefetcher); ok {
+		p.Prefetch()
+	}
+}
+
+// newChunkReaderAt returns a chunkReader that starts at offset, and
+// accounts for the chunks it skips in result.
+func newChunkReaderAt(src ChunkSource, offset int64, shardId int, progressCh chan<- XUpdMsg, result *ExtractResult) (*chunkReader, error) {
+	r := newChunkReader(src, shardId, progressCh, result)
+	files, _ := src.(chunkFiles)
+	sizer, _ := src.(chunkSizer)
+	for ; r.idx < src.Len(); r.idx++ {
+		size, known := int64(0), false
+		if files != nil {
+			// Deleted chunks, see DeleteConsumedChunks
+			size, known = files.deleted().size(filepath.Base(files.chunkPath(r.idx)))
+		}
+		if !known && sizer != nil {
+			var err error
+			if size, err = sizer.ChunkSize(r.idx); err != nil {
+				return nil, err
+			}
+			known = true
+		}
+		if known && size <= offset {
+			result.BytesIn += size
+			offset -= size
+			result.Chunks++
+			continue
+		}
+		f, err := src.Open(r.idx)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		if s, ok := f.(io.Seeker); ok {
+			if n, err = s.Seek(0, io.SeekEnd); err == nil && n > offset {
+				n, err = s.Seek(offset, io.SeekStart)
+			}
+		} else if n, err = io.CopyN(io.Discard, f, offset); err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		result.BytesIn += n
+		offset -= n
+		if offset == 0 {
+			r.current = f
+			return r, nil
+		}
+		f.Close()
+		result.Chunks++
+	}
+	return nil, fmt.Errorf("shard %d: resuming past the end of the archive", shardId)
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.idx >= r.src.Len() {
+				return 0, io.EOF
+			}
+			f, err := r.src.Open(r.idx)
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+		}
+		n, err := r.current.Read(p)
+		r.result.BytesIn += int64(n)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			r.idx++
+			r.result.Chunks++
+			if r.progressCh != nil {
+				r.progressCh <- XUpdMsg{
+					Total: r.src.Len(),
+					Shard: r.shardId,
+					Idx:   r.idx,
+				}
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
@@ -0,0 +1,416 @@
+package downloader
+
+/*
+Random access to the files of a shard.
+
+An index maps each tar entry of a shard's archive to a checkpoint
+(see inflate.go) decompression can start from to reach it, so that
+a few files can be extracted without decompressing the whole shard.
+
+It is saved next to the chunks, in <download dir>/shard-<id>.index,
+as gzip-compressed JSON lines. It is built during the extraction,
+when the archive is read by the "go" decompressor or is not
+compressed, or by BuildIndex.
+*/
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Decompression starts at most indexEvery bytes before an entry.
+const indexEvery = 64 << 20
+
+// IndexPath returns the path of the index of a shard's chunks.
+func IndexPath(rootSrcDir string, shardId int) string {
+	return filepath.Join(rootSrcDir, fmt.Sprintf("shard-%d.index", shardId))
+}
+
+// indexedSource is implemented by the chunk sources that are saved on
+// disk, next to which an index can be saved.
+type indexedSource interface {
+	IndexPath() string
+}
+
+// IndexEntry locates a tar entry in a shard's archive.
+type IndexEntry struct {
+	Name string `json:"name"`
+	Type byte   `json:"type"`
+	Size int64  `json:"size"`
+	// Offset is where the entry starts in the tar stream.
+	Offset int64 `json:"offset"`
+	// Checkpoint is the one to decompress from, or -1 for the start
+	// of the archive.
+	Checkpoint int `json:"checkpoint"`
+}
+
+type indexHeader struct {
+	Format string `json:"format"`
+	Head   uint32 `json:"head"` // CRC-32 of the first 512 bytes of the archive
+}
+
+// indexRecord is a line of the index file, with one of its fields set.
+// Checkpoints are numbered in the order they appear.
+type indexRecord struct {
+	Header     *indexHeader    `json:"header,omitempty"`
+	Checkpoint *gzipCheckpoint `json:"checkpoint,omitempty"`
+	Entry      *IndexEntry     `json:"entry,omitempty"`
+}
+
+// Index is the index of a shard's archive.
+type Index struct {
+	indexHeader
+	Entries     []IndexEntry
+	checkpoints []gzipCheckpoint
+}
+
+// ReadIndex reads an index written by BuildIndex, or during the extraction.
+func ReadIndex(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	index := &Index{}
+	dec := json.NewDecoder(gz)
+	for {
+		var rec indexRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		switch {
+		case rec.Header != nil:
+			index.indexHeader = *rec.Header
+		case rec.Checkpoint != nil:
+			index.checkpoints = append(index.checkpoints, *rec.Checkpoint)
+		case rec.Entry != nil:
+			index.Entries = append(index.Entries, *rec.Entry)
+		}
+	}
+	if index.Format == "" {
+		return nil, fmt.Errorf("%s: not an index", path)
+	}
+	sort.Slice(index.Entries, func(i, j int) bool { return index.Entries[i].Offset < index.Entries[j].Offset })
+	return index, nil
+}
+
+// Match returns the entries whose name, or name relative to the shard
+// directory, matches one of patterns (see path.Match), in archive order.
+func (index *Index) Match(shardId int, patterns []string) ([]IndexEntry, error) {
+	prefix := fmt.Sprintf("shard-%d/", shardId)
+	var (
+		entries   []IndexEntry
+		unmatched []string
+	)
+	matched := make(map[int]bool)
+	for _, pattern := range patterns {
+		found := false
+		for i, e := range index.Entries {
+			name := strings.TrimPrefix(e.Name, "./")
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				ok, _ = path.Match(pattern, strings.TrimPrefix(name, prefix))
+			}
+			if ok {
+				found = true
+				if !matched[i] {
+					matched[i] = true
+					entries = append(entries, e)
+				}
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	if len(unmatched) > 0 {
+		return nil, fmt.Errorf("not found in shard %d: %s", shardId, strings.Join(unmatched, ", "))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	return entries, nil
+}
+
+// indexWriter writes an index while the archive is read.
+type indexWriter struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	outs []int64 // Out of the checkpoints written so far
+	err  error
+}
+
+// newIndexWriter starts writing an index to a temporary file, that
+// replaces path on commit.
+func newIndexWriter(path, format string, head uint32) (*indexWriter, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &indexWriter{path: path, file: f, gz: gzip.NewWriter(f)}
+	w.enc = json.NewEncoder(w.gz)
+	w.err = w.enc.Encode(indexRecord{Header: &indexHeader{Format: format, Head: head}})
+	return w, nil
+}
+
+func (w *indexWriter) checkpoint(cp gzipCheckpoint) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.enc.Encode(indexRecord{Checkpoint: &cp})
+		w.outs = append(w.outs, cp.Out)
+	}
+}
+
+// entry records a tar entry that starts at offset. All the checkpoints
+// before it have been recorded already: they were produced before the
+// data of the entry.
+func (w *indexWriter) entry(offset int64, hdr *tar.Header) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		cp := sort.Search(len(w.outs), func(i int) bool { return w.outs[i] > offset }) - 1
+		w.err = w.enc.Encode(indexRecord{Entry: &IndexEntry{
+			Name:       hdr.Name,
+			Type:       hdr.Typeflag,
+			Size:       hdr.Size,
+			Offset:     offset,
+			Checkpoint: cp,
+		}})
+	}
+}
+
+// commit saves the index, once the whole archive has been read.
+func (w *indexWriter) commit() error {
+	err := w.err
+	if e := w.gz.Close(); err == nil {
+		err = e
+	}
+	if err == nil && Fsync != FsyncNever {
+		err = w.file.Sync()
+	}
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		return err
+	}
+	return syncParent(w.path)
+}
+
+func (w *indexWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// indexableDecompressor returns the decompressor to index an archive
+// with: only ours can save checkpoints.
+func indexableDecompressor(d Decompressor) (Decompressor, error) {
+	switch decompressorFormats[d.Name] {
+	case FormatGzip:
+		return Decompressor{Name: "go"}, nil
+	case FormatTar:
+		return d, nil
+	}
+	return d, fmt.Errorf("%s archives can not be indexed", decompressorFormats[d.Name])
+}
+
+// ArchiveHead returns the CRC-32 of the first 512 bytes of a shard's
+// archive, to check that an index is for these chunks.
+func ArchiveHead(src ChunkSource) (uint32, error) {
+	f, err := src.Open(0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(header[:n]), nil
+}
+
+// BuildIndex reads a shard's archive to the end, and saves its index
+// in path. Use it when the index could not be built during extraction.
+func BuildIndex(src ChunkSource, path string, shardId int) (*Index, error) {
+	var result ExtractResult
+	chunks, archive, d, err := openShardStream(src, "auto", "go", shardId, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	defer chunks.Close()
+	prefetch(src)
+	if d, err = indexableDecompressor(d); err != nil {
+		return nil, err
+	}
+	header, _ := archive.Peek(512)
+	w, err := newIndexWriter(path, decompressorFormats[d.Name], crc32.ChecksumIEEE(header))
+	if err != nil {
+		return nil, err
+	}
+	var decompressed io.ReadCloser = io.NopCloser(archive)
+	if d.Name == "go" {
+		f := newInflater(archive)
+		f.checkpoint, f.every = w.checkpoint, indexEvery
+		decompressed = f
+	}
+	stream := &tarStream{ReadCloser: decompressed}
+	tr := tar.NewReader(stream)
+	for {
+		offset := stream.nextEntry()
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			w.entry(offset, hdr)
+			_, err = io.Copy(io.Discard, tr)
+		}
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if err := decompressed.Close(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.commit(); err != nil {
+		return nil, err
+	}
+	return ReadIndex(path)
+}
+
+// ExtractEntries extracts the given entries of a shard's archive (see
+// Index.Match) into dstDir, decompressing only what is needed to reach
+// them. Progress is reported to progressCh, like Extract does.
+func (index *Index) ExtractEntries(src ChunkSource, entries []IndexEntry, dstDir string, shardId int, progressCh chan<- XUpdMsg) error {
+	r := &indexReader{index: index, src: src, shardId: shardId}
+	defer r.close()
+	w := newFileWriter(dstDir, shardId, progressCh)
+	for _, e := range entries {
+		hdr, tr, err := r.seek(e)
+		if err == nil {
+			err = w.entry(hdr, tr)
+		}
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// WriteEntry writes the content of a regular file of the archive to out.
+func (index *Index) WriteEntry(src ChunkSource, e IndexEntry, out io.Writer) error {
+	r := &indexReader{index: index, src: src}
+	defer r.close()
+	_, tr, err := r.seek(e)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, tr)
+	return err
+}
+
+// indexReader reads entries of an archive, in order, restarting
+// decompression from a checkpoint when the next entry is far ahead.
+type indexReader struct {
+	index      *Index
+	src        ChunkSource
+	shardId    int
+	chunks     *chunkReader
+	stream     *tarStream
+	checkpoint int
+	result     ExtractResult
+}
+
+// seek returns the header and the reader of an entry.
+func (r *indexReader) seek(e IndexEntry) (*tar.Header, io.Reader, error) {
+	if r.stream == nil || e.Offset < r.stream.pos || e.Checkpoint != r.checkpoint && e.Offset-r.stream.pos >= indexEvery {
+		if err := r.open(e.Checkpoint, e.Offset); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, err := io.CopyN(io.Discard, r.stream, e.Offset-r.stream.pos); err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(r.stream)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name != e.Name {
+		return nil, nil, fmt.Errorf("shard %d: found %s instead of %s, the index is out of date", r.shardId, hdr.Name, e.Name)
+	}
+	return hdr, tr, nil
+}
+
+// open starts reading the archive from a checkpoint, or from offset
+// if it is not compressed.
+func (r *indexReader) open(checkpoint int, offset int64) error {
+	r.close()
+	var (
+		in     int64
+		stream io.ReadCloser
+		pos    int64
+	)
+	switch {
+	case r.index.Format == FormatTar:
+		in, pos = offset, offset
+	case checkpoint >= 0 && checkpoint < len(r.index.checkpoints):
+		in, pos = r.index.checkpoints[checkpoint].In, r.index.checkpoints[checkpoint].Out
+	case checkpoint >= 0:
+		return fmt.Errorf("invalid index: no checkpoint %d", checkpoint)
+	}
+	chunks, err := newChunkReaderAt(r.src, in, r.shardId, nil, &r.result)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.index.Format == FormatTar:
+		stream = io.NopCloser(chunks)
+	case checkpoint >= 0:
+		stream = newInflaterAt(chunks, r.index.checkpoints[checkpoint])
+	default:
+		stream = newInflater(chunks)
+	}
+	r.chunks, r.checkpoint = chunks, checkpoint
+	r.stream = &tarStream{ReadCloser: stream, pos: pos}
+	return nil
+}
+
+func (r *indexReader) close() {
+	if r.chunks != nil {
+		r.chunks.Close()
+		r.chunks, r.stream = nil, nil
+	}
+}
@@ -0,0 +1,702 @@
+package downloader
+
+/*
+A gzip decompressor that can save its state at deflate block
+boundaries, and resume from there, like zlib's zran.c example.
+
+At the start of a block, the state of the decompressor is just
+the position in the compressed stream (to the bit), and the last
+32 KiB of output, which later blocks may refer to. That is what
+a gzipCheckpoint holds (see checkpoint.go for how it is used).
+
+compress/flate does not expose block boundaries, hence this
+implementation. It is used by the "go" decompressor.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	inflateWindow = 1 << 15 // the maximum distance of a deflate match
+	inflateBuffer = 1 << 18 // output buffer, besides the window
+	huffPrimary   = 10      // bits decoded with the primary table
+)
+
+var (
+	errGzipHeader   = errors.New("gzip: invalid header")
+	errGzipChecksum = errors.New("gzip: invalid checksum")
+	errDeflate      = errors.New("gzip: corrupt deflate stream")
+)
+
+// gzipCheckpoint is the state of the decompressor at the start of a
+// deflate block.
+type gzipCheckpoint struct {
+	In     int64  `json:"in"`     // offset of the byte holding the first bit of the block
+	Bits   uint   `json:"bits"`   // bits of that byte that belong to the previous block
+	Out    int64  `json:"out"`    // offset in the decompressed stream
+	CRC    uint32 `json:"crc"`    // CRC-32 of the current gzip member so far
+	Size   uint32 `json:"size"`   // size of the current gzip member so far, modulo 2^32
+	Window []byte `json:"window"` // up to the last 32 KiB of output
+}
+
+const (
+	stateHeader = iota
+	stateBlock
+	stateStored
+	stateHuffman
+	stateTrailer
+	stateDone
+)
+
+// inflater decompresses a (possibly multi-member) gzip stream.
+type inflater struct {
+	r     io.Reader
+	in    []byte
+	inPos int
+	inEnd int
+	inOff int64 // offset of in[0] in the compressed stream
+	inErr error
+
+	// Bits above nbits are either zero or copies of the following
+	// input bytes, so that refill can load 8 bytes at a time.
+	bits  uint64
+	nbits uint
+	skip  uint // bits to drop before resuming
+
+	win    []byte // history, followed by output waiting to be read
+	wpos   int
+	rpos   int
+	sumPos int // output up to sumPos is accounted for in total and crc
+	total  int64
+	crc    uint32
+	size   uint32
+
+	state     int
+	members   int
+	final     bool
+	stored    int // bytes left in the stored block
+	lit, dist *huffmanTable
+	dynLit    huffmanTable
+	dynDist   huffmanTable
+	copyLen   int // match left to copy when the buffer got full
+	copyDist  int
+
+	// checkpoint, if set, is called at the start of a block once at
+	// least every bytes have been decompressed since the last call.
+	checkpoint func(gzipCheckpoint)
+	every      int64
+	lastCp     int64
+
+	err error
+}
+
+func newInflater(r io.Reader) *inflater {
+	return &inflater{
+		r:   r,
+		in:  make([]byte, 1<<16),
+		win: make([]byte, inflateWindow+inflateBuffer),
+	}
+}
+
+// newInflaterAt resumes decompression from a checkpoint. r must start at
+// the byte cp.In of the compressed stream.
+func newInflaterAt(r io.Reader, cp gzipCheckpoint) *inflater {
+	f := newInflater(r)
+	f.inOff = cp.In
+	f.skip = cp.Bits
+	f.wpos = copy(f.win, cp.Window)
+	f.rpos, f.sumPos = f.wpos, f.wpos
+	f.total, f.crc, f.size = cp.Out, cp.CRC, cp.Size
+	f.lastCp = cp.Out
+	f.members = 1
+	f.state = stateBlock
+	return f
+}
+
+func (f *inflater) Read(p []byte) (int, error) {
+	for f.rpos == f.wpos {
+		if f.err != nil {
+			return 0, f.err
+		}
+		if f.wpos == len(f.win) {
+			f.slide()
+		}
+		f.err = f.fill()
+		f.sum()
+	}
+	n := copy(p, f.win[f.rpos:f.wpos])
+	f.rpos += n
+	return n, nil
+}
+
+// Close reads the stream up to the end, so that its checksums
+// get verified.
+func (f *inflater) Close() error {
+	_, err := io.Copy(io.Discard, f)
+	return err
+}
+
+// slide keeps the last 32 KiB of output, once all of it has been read.
+func (f *inflater) slide() {
+	n := copy(f.win, f.win[f.wpos-inflateWindow:f.wpos])
+	f.wpos, f.rpos, f.sumPos = n, n, n
+}
+
+// sum accounts for the output produced since the last call.
+func (f *inflater) sum() {
+	out := f.win[f.sumPos:f.wpos]
+	f.crc = crc32.Update(f.crc, crc32.IEEETable, out)
+	f.size += uint32(len(out))
+	f.total += int64(len(out))
+	f.sumPos = f.wpos
+}
+
+// fill decompresses until the output buffer is full, or the stream ends.
+func (f *inflater) fill() error {
+	for f.wpos < len(f.win) {
+		var err error
+		switch f.state {
+		case stateHeader:
+			err = f.header()
+		case stateBlock:
+			err = f.blockHeader()
+		case stateStored:
+			err = f.storedBlock()
+		case stateHuffman:
+			err = f.huffmanBlock()
+		case stateTrailer:
+			err = f.trailer()
+		case stateDone:
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// more reads compressed data into the input buffer.
+// It returns false at the end of the input.
+func (f *inflater) more() bool {
+	if f.inErr != nil {
+		return false
+	}
+	n := copy(f.in, f.in[f.inPos:f.inEnd])
+	f.inOff += int64(f.inPos)
+	f.inPos, f.inEnd = 0, n
+	for f.inEnd == n {
+		m, err := f.r.Read(f.in[f.inEnd:])
+		f.inEnd += m
+		if err != nil {
+			f.inErr = err
+			break
+		}
+	}
+	return f.inEnd > n
+}
+
+// refill loads the bit buffer with at least 56 bits, unless the
+// input ends before.
+func (f *inflater) refill() {
+	if f.inEnd-f.inPos >= 8 {
+		f.bits |= binary.LittleEndian.Uint64(f.in[f.inPos:]) << f.nbits
+		k := (63 - f.nbits) >> 3
+		f.inPos += int(k)
+		f.nbits += k * 8
+		return
+	}
+	for f.nbits <= 56 {
+		if f.inPos == f.inEnd && !f.more() {
+			return
+		}
+		f.bits |= uint64(f.in[f.inPos]) << f.nbits
+		f.inPos++
+		f.nbits += 8
+	}
+}
+
+func (f *inflater) inputErr() error {
+	if f.inErr != nil && f.inErr != io.EOF {
+		return f.inErr
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// getBits returns the next n bits (up to 32) of the stream.
+func (f *inflater) getBits(n uint) (uint32, error) {
+	if f.nbits < n {
+		f.refill()
+		if f.nbits < n {
+			return 0, f.inputErr()
+		}
+	}
+	v := uint32(f.bits & (1<<n - 1))
+	f.bits >>= n
+	f.nbits -= n
+	return v, nil
+}
+
+// align drops the bits left in the current byte.
+func (f *inflater) align() {
+	n := f.nbits & 7
+	f.bits >>= n
+	f.nbits -= n
+}
+
+// position returns the offset of the next bit in the compressed stream.
+func (f *inflater) position() (int64, uint) {
+	pos := (f.inOff+int64(f.inPos))*8 - int64(f.nbits)
+	return pos / 8, uint(pos % 8)
+}
+
+// atEOF reports if the compressed stream ends at the current byte.
+func (f *inflater) atEOF() bool {
+	return f.nbits == 0 && f.inPos == f.inEnd && !f.more()
+}
+
+func (f *inflater) header() error {
+	if f.atEOF() {
+		if f.members == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		f.state = stateDone
+		return nil
+	}
+	var hdr [10]byte
+	for i := range hdr {
+		b, err := f.getBits(8)
+		if err != nil {
+			return err
+		}
+		hdr[i] = byte(b)
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return errGzipHeader
+	}
+	flags := hdr[3]
+	if flags&0x04 != 0 { // FEXTRA
+		n, err := f.getBits(16)
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			if _, err := f.getBits(8); err != nil {
+				return err
+			}
+		}
+	}
+	for _, flag := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			b, err := f.getBits(8)
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flags&0x02 != 0 { // FHCRC
+		if _, err := f.getBits(16); err != nil {
+			return err
+		}
+	}
+	f.crc, f.size = 0, 0
+	f.members++
+	f.final = false
+	f.state = stateBlock
+	return nil
+}
+
+func (f *inflater) trailer() error {
+	f.sum()
+	f.align()
+	crc, err := f.getBits(32)
+	if err != nil {
+		return err
+	}
+	size, err := f.getBits(32)
+	if err != nil {
+		return err
+	}
+	if crc != f.crc || size != f.size {
+		return errGzipChecksum
+	}
+	f.state = stateHeader
+	return nil
+}
+
+func (f *inflater) blockHeader() error {
+	if f.final {
+		f.state = stateTrailer
+		return nil
+	}
+	if f.skip > 0 {
+		if _, err := f.getBits(f.skip); err != nil {
+			return err
+		}
+		f.skip = 0
+	}
+	if f.checkpoint != nil && f.total+int64(f.wpos-f.sumPos)-f.lastCp >= f.every {
+		f.sum()
+		in, bits := f.position()
+		start := max(0, f.wpos-inflateWindow)
+		f.checkpoint(gzipCheckpoint{
+			In: in, Bits: bits,
+			Out: f.total, CRC: f.crc, Size: f.size,
+			Window: append([]byte(nil), f.win[start:f.wpos]...),
+		})
+		f.lastCp = f.total
+	}
+
+	v, err := f.getBits(3)
+	if err != nil {
+		return err
+	}
+	f.final = v&1 == 1
+	switch v >> 1 {
+	case 0:
+		f.align()
+		v, err := f.getBits(32)
+		if err != nil {
+			return err
+		}
+		if uint16(v) != ^uint16(v>>16) {
+			return errDeflate
+		}
+		f.stored = int(uint16(v))
+		f.state = stateStored
+	case 1:
+		f.lit, f.dist = &fixedLit, &fixedDist
+		f.state = stateHuffman
+	case 2:
+		if err := f.dynamicTables(); err != nil {
+			return err
+		}
+		f.lit, f.dist = &f.dynLit, &f.dynDist
+		f.state = stateHuffman
+	default:
+		return errDeflate
+	}
+	return nil
+}
+
+func (f *inflater) storedBlock() error {
+	// Whole bytes may be left in the bit buffer
+	for f.stored > 0 && f.nbits >= 8 && f.wpos < len(f.win) {
+		f.win[f.wpos] = byte(f.bits)
+		f.bits >>= 8
+		f.nbits -= 8
+		f.wpos++
+		f.stored--
+	}
+	if f.nbits == 0 {
+		f.bits = 0 // drop the copies of the input we are about to consume
+	}
+	for f.stored > 0 && f.wpos < len(f.win) {
+		if f.inPos == f.inEnd && !f.more() {
+			return f.inputErr()
+		}
+		n := copy(f.win[f.wpos:min(len(f.win), f.wpos+f.stored)], f.in[f.inPos:f.inEnd])
+		f.inPos += n
+		f.wpos += n
+		f.stored -= n
+	}
+	if f.stored == 0 {
+		f.state = stateBlock
+	}
+	return nil
+}
+
+var codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+func (f *inflater) dynamicTables() error {
+	v, err := f.getBits(14)
+	if err != nil {
+		return err
+	}
+	nlit, ndist, nclen := int(v&31)+257, int(v>>5&31)+1, int(v>>10)+4
+	if nlit > 286 || ndist > 30 {
+		return errDeflate
+	}
+	var clens [19]uint8
+	for i := 0; i < nclen; i++ {
+		v, err := f.getBits(3)
+		if err != nil {
+			return err
+		}
+		clens[codeLengthOrder[i]] = uint8(v)
+	}
+	var cl huffmanTable
+	if err := cl.init(clens[:]); err != nil {
+		return err
+	}
+
+	var lengths [286 + 30]uint8
+	for i := 0; i < nlit+ndist; {
+		sym, err := f.decode(&cl)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var rep int
+		var val uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errDeflate
+			}
+			v, err = f.getBits(2)
+			rep, val = 3+int(v), lengths[i-1]
+		case 17:
+			v, err = f.getBits(3)
+			rep = 3 + int(v)
+		default:
+			v, err = f.getBits(7)
+			rep = 11 + int(v)
+		}
+		if err != nil {
+			return err
+		}
+		if i+rep > nlit+ndist {
+			return errDeflate
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = val
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errDeflate
+	}
+	if err := f.dynLit.init(lengths[:nlit]); err != nil {
+		return err
+	}
+	return f.dynDist.init(lengths[nlit : nlit+ndist])
+}
+
+// decode reads a symbol coded with h.
+func (f *inflater) decode(h *huffmanTable) (int, error) {
+	if f.nbits < 15 {
+		f.refill()
+	}
+	e := h.table[f.bits&(1<<huffPrimary-1)]
+	if e&huffLink != 0 {
+		e = h.table[int(e>>16)+int(f.bits>>huffPrimary&(1<<(e&31)-1))]
+	}
+	n := uint(e & 31)
+	if n == 0 || n > f.nbits {
+		if n > f.nbits {
+			return 0, f.inputErr()
+		}
+		return 0, errDeflate
+	}
+	f.bits >>= n
+	f.nbits -= n
+	return int(e >> 16), nil
+}
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+func (f *inflater) huffmanBlock() error {
+	win := f.win
+	wpos := f.wpos
+	defer func() { f.wpos = wpos }()
+
+	length, dist := f.copyLen, f.copyDist
+	for {
+		if length > 0 {
+			// Copy a match, possibly overlapping with its own output
+			n := min(length, len(win)-wpos)
+			src := wpos - dist
+			for done := 0; done < n; {
+				done += copy(win[wpos+done:wpos+n], win[src:wpos+done])
+			}
+			wpos += n
+			length -= n
+			if length > 0 {
+				f.copyLen, f.copyDist = length, dist
+				return nil
+			}
+			f.copyLen = 0
+		}
+		if wpos == len(win) {
+			return nil
+		}
+
+		// The longest symbol (length code, extra bits, distance code,
+		// extra bits) takes 48 bits.
+		if f.nbits < 48 {
+			f.refill()
+		}
+		sym, err := f.decode(f.lit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			win[wpos] = byte(sym)
+			wpos++
+			continue
+		case sym == 256:
+			f.state = stateBlock
+			return nil
+		case sym > 285:
+			return errDeflate
+		}
+		sym -= 257
+		v, err := f.getBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length = int(lengthBase[sym]) + int(v)
+
+		sym, err = f.decode(f.dist)
+		if err != nil {
+			return err
+		}
+		if sym > 29 {
+			return errDeflate
+		}
+		v, err = f.getBits(uint(distExtra[sym]))
+		if err != nil {
+			return err
+		}
+		dist = int(distBase[sym]) + int(v)
+		if dist > wpos {
+			return errDeflate
+		}
+	}
+}
+
+// huffmanTable decodes canonical Huffman codes. Codes up to huffPrimary
+// bits are decoded with a single lookup, longer ones with a second lookup
+// in a subtable. An entry holds the symbol (or the offset of the subtable)
+// in its high 16 bits, and the length of the code (or the number of bits
+// that index the subtable) in its low 5 bits.
+type huffmanTable struct {
+	table []uint32
+}
+
+const huffLink = 1 << 8 // the entry points to a subtable
+
+func (h *huffmanTable) init(lengths []uint8) error {
+	var count [16]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	left := 1
+	for l := 1; l <= 15; l++ {
+		left = left<<1 - count[l]
+		if left < 0 {
+			return errDeflate // over-subscribed
+		}
+	}
+	var next [16]int
+	for l, code := 1, 0; l <= 15; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	// Codes are stored most significant bit first, in a stream read
+	// least significant bit first: index tables with reversed codes.
+	var codes [286 + 30]uint16
+	var subLen [1 << huffPrimary]uint8
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		code := uint16(next[l])
+		next[l]++
+		var rev uint16
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | code>>i&1
+		}
+		codes[sym] = rev
+		if l > huffPrimary {
+			prefix := rev & (1<<huffPrimary - 1)
+			subLen[prefix] = max(subLen[prefix], l-huffPrimary)
+		}
+	}
+
+	size := 1 << huffPrimary
+	for _, n := range subLen {
+		if n > 0 {
+			size += 1 << n
+		}
+	}
+	if cap(h.table) < size {
+		h.table = make([]uint32, size)
+	}
+	h.table = h.table[:size]
+	clear(h.table)
+	offset := 1 << huffPrimary
+	for prefix, n := range subLen {
+		if n > 0 {
+			h.table[prefix] = uint32(offset)<<16 | huffLink | uint32(n)
+			offset += 1 << n
+		}
+	}
+
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		entry := uint32(sym)<<16 | uint32(l)
+		rev := int(codes[sym])
+		if l <= huffPrimary {
+			for i := rev; i < 1<<huffPrimary; i += 1 << l {
+				h.table[i] = entry
+			}
+			continue
+		}
+		link := h.table[rev&(1<<huffPrimary-1)]
+		sub := h.table[link>>16:][:1<<(link&31)]
+		for i := rev >> huffPrimary; i < len(sub); i += 1 << (l - huffPrimary) {
+			sub[i] = entry
+		}
+	}
+	return nil
+}
+
+var fixedLit, fixedDist huffmanTable
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLit.init(lengths[:])
+	var dist [30]uint8
+	for i := range dist {
+		dist[i] = 5
+	}
+	fixedDist.init(dist[:])
+}
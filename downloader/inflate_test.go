@@ -0,0 +1,236 @@
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var inflateLevels = []struct {
+	name  string
+	level int
+}{
+	{"stored", gzip.NoCompression},
+	{"fastest", gzip.BestSpeed},
+	{"default", gzip.DefaultCompression},
+	{"best", gzip.BestCompression},
+	{"huffman", gzip.HuffmanOnly},
+}
+
+// testData returns n bytes that compress unevenly: runs of words, that
+// give matches at every distance, and runs of random bytes.
+func testData(n int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := []string{"shard", "chunk", "snapshot", "rocksdb", "farcaster", "hub", "\n", " ", "0x", "sst"}
+	var b bytes.Buffer
+	for b.Len() < n {
+		if rnd.Intn(8) == 0 {
+			run := make([]byte, rnd.Intn(4096))
+			rnd.Read(run)
+			b.Write(run)
+			continue
+		}
+		for i := rnd.Intn(512); i > 0; i-- {
+			b.WriteString(words[rnd.Intn(len(words))])
+		}
+	}
+	return b.Bytes()[:n]
+}
+
+// gzipMember compresses data as one gzip member.
+func gzipMember(t *testing.T, data []byte, level int, hdr gzip.Header) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Header = hdr
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// gunzip decompresses z with compress/gzip.
+func gunzip(t *testing.T, z []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// inflate decompresses z with the inflater, reading it in small pieces
+// so that the input buffer gets refilled in the middle of blocks.
+func inflate(z []byte, every int64, checkpoint func(gzipCheckpoint)) ([]byte, error) {
+	f := newInflater(&shortReader{r: bytes.NewReader(z)})
+	f.checkpoint, f.every = checkpoint, every
+	return io.ReadAll(f)
+}
+
+// shortReader returns short reads every few calls.
+type shortReader struct {
+	r *bytes.Reader
+	n int
+}
+
+func (o *shortReader) Read(p []byte) (int, error) {
+	o.n++
+	if o.n%3 == 0 && len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
+
+func TestInflateLevels(t *testing.T) {
+	data := testData(3<<20, 1)
+	for _, l := range inflateLevels {
+		t.Run(l.name, func(t *testing.T) {
+			z := gzipMember(t, data, l.level, gzip.Header{})
+			got, err := inflate(z, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, gunzip(t, z)) {
+				t.Fatal("output differs from compress/gzip")
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("output differs from the input")
+			}
+		})
+	}
+}
+
+func TestInflateEmpty(t *testing.T) {
+	got, err := inflate(gzipMember(t, nil, gzip.DefaultCompression, gzip.Header{}), 0, nil)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestInflateMultistream(t *testing.T) {
+	var z, data []byte
+	for i, l := range inflateLevels {
+		part := testData(200<<10+i*12345, int64(i))
+		data = append(data, part...)
+		// Optional header fields are skipped
+		hdr := gzip.Header{Name: "shard-0.tar", Comment: "member", Extra: []byte{'s', 'd', 2, 0, 1, 2}}
+		z = append(z, gzipMember(t, part, l.level, hdr)...)
+	}
+	z = append(z, gzipMember(t, nil, gzip.BestSpeed, gzip.Header{})...)
+
+	got, err := inflate(z, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, gunzip(t, z)) || !bytes.Equal(got, data) {
+		t.Fatal("output differs from compress/gzip")
+	}
+}
+
+func TestInflateResume(t *testing.T) {
+	data := testData(2<<20, 2)
+	streams := map[string][]byte{}
+	for _, l := range inflateLevels {
+		streams[l.name] = gzipMember(t, data, l.level, gzip.Header{})
+	}
+	// The checkpoints of the second member start from a window that holds
+	// the end of the first one.
+	streams["multistream"] = append(gzipMember(t, data[:700<<10], gzip.BestSpeed, gzip.Header{}),
+		gzipMember(t, data[700<<10:], gzip.BestCompression, gzip.Header{})...)
+
+	for name, z := range streams {
+		t.Run(name, func(t *testing.T) {
+			var cps []gzipCheckpoint
+			if _, err := inflate(z, 32<<10, func(cp gzipCheckpoint) { cps = append(cps, cp) }); err != nil {
+				t.Fatal(err)
+			}
+			if len(cps) < 2 {
+				t.Fatalf("only %d checkpoints", len(cps))
+			}
+			for _, cp := range cps {
+				// Checkpoints are saved as JSON
+				saved, err := json.Marshal(cp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var loaded gzipCheckpoint
+				if err := json.Unmarshal(saved, &loaded); err != nil {
+					t.Fatal(err)
+				}
+				f := newInflaterAt(&shortReader{r: bytes.NewReader(z[loaded.In:])}, loaded)
+				got, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatalf("resuming at in=%d bits=%d out=%d: %v", cp.In, cp.Bits, cp.Out, err)
+				}
+				if !bytes.Equal(got, data[cp.Out:]) {
+					t.Fatalf("resuming at in=%d bits=%d out=%d: output differs", cp.In, cp.Bits, cp.Out)
+				}
+			}
+		})
+	}
+}
+
+func TestInflateTruncated(t *testing.T) {
+	data := testData(512<<10, 3)
+	for _, l := range inflateLevels {
+		z := gzipMember(t, data, l.level, gzip.Header{})
+		cuts := []int{0, 1, 9, 10, len(z) - 8, len(z) - 4, len(z) - 1}
+		for i := 1; i < 20; i++ {
+			cuts = append(cuts, len(z)*i/20)
+		}
+		for _, n := range cuts {
+			if _, err := inflate(z[:n], 0, nil); err != io.ErrUnexpectedEOF {
+				t.Errorf("%s, %d of %d bytes: got %v, expected %v", l.name, n, len(z), err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+func TestInflateCorrupt(t *testing.T) {
+	data := testData(512<<10, 4)
+	corrupt := func(z []byte, i int) []byte {
+		z = append([]byte(nil), z...)
+		z[i] ^= 0x55
+		return z
+	}
+	for _, l := range inflateLevels {
+		z := gzipMember(t, data, l.level, gzip.Header{})
+		for _, c := range []struct {
+			name string
+			z    []byte
+			err  error
+		}{
+			{"magic", corrupt(z, 0), errGzipHeader},
+			{"method", corrupt(z, 2), errGzipHeader},
+			{"crc", corrupt(z, len(z)-8), errGzipChecksum},
+			{"size", corrupt(z, len(z)-1), errGzipChecksum},
+			{"trailing garbage", append(append([]byte(nil), z...), "garbage!!!"...), errGzipHeader},
+		} {
+			if _, err := inflate(c.z, 0, nil); err != c.err {
+				t.Errorf("%s, %s: got %v, expected %v", l.name, c.name, err, c.err)
+			}
+		}
+		// Anywhere in the deflate stream, corruption is caught by the
+		// decoder or by the checksum.
+		for i := 1; i < 50; i++ {
+			_, err := inflate(corrupt(z, 10+(len(z)-18)*i/50), 0, nil)
+			if !errors.Is(err, errDeflate) && !errors.Is(err, errGzipChecksum) && err != io.ErrUnexpectedEOF {
+				t.Errorf("%s, byte %d: got %v", l.name, i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DatabaseInUse returns an error if a process holds the RocksDB database
+// in dir: if its LOCK file is locked (on Unix), or if a process has files
+// open in it (on Linux). Processes of other users can only be seen by
+// root.
+func DatabaseInUse(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if pid, locked := lockHolder(filepath.Join(dir, "LOCK")); locked {
+		holder := ""
+		if pid > 0 {
+			holder = " by " + describeProcess(pid)
+		}
+		return fmt.Errorf("the database in %s is in use: its LOCK file is locked%s. Stop the node first", dir, holder)
+	}
+	if pids := openIn(dir); len(pids) > 0 {
+		holders := make([]string, len(pids))
+		for i, pid := range pids {
+			holders[i] = describeProcess(pid)
+		}
+		return fmt.Errorf("the database in %s is in use: files are open in it by %s. Stop the node first", dir, strings.Join(holders, ", "))
+	}
+	return nil
+}
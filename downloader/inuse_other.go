@@ -0,0 +1,14 @@
+//go:build !linux
+
+package downloader
+
+import "fmt"
+
+// openIn can only list the processes that have files open on Linux.
+func openIn(dir string) []int {
+	return nil
+}
+
+func describeProcess(pid int) string {
+	return fmt.Sprintf("PID %d", pid)
+}
@@ -0,0 +1,175 @@
+package downloader
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot describes one snapshot found in the bucket for a shard.
+type Snapshot struct {
+	Endpoint  string
+	Shard     int
+	KeyBase   string
+	Timestamp int // ms, same unit as Metadata.Timestamp
+	Chunks    []string
+	Size      int64
+}
+
+// Metadata returns the Metadata needed to download this snapshot,
+// as if it had been read from latest.json.
+func (s *Snapshot) Metadata() *Metadata {
+	return &Metadata{
+		KeyBase:   s.KeyBase,
+		Chunks:    s.Chunks,
+		Timestamp: s.Timestamp,
+		Endpoint:  s.Endpoint,
+	}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ShardPrefix returns the bucket prefix under which a shard's snapshots are stored.
+func ShardPrefix(shard int) string {
+	return fmt.Sprintf("FARCASTER_NETWORK_%s/%d/", Network, shard)
+}
+
+// ListSnapshots enumerates all snapshot-*.tar.gz key bases of a shard using
+// S3 ListObjectsV2. The result is sorted by timestamp, newest first.
+func ListSnapshots(endpointURL string, shard int) ([]*Snapshot, error) {
+	prefix := ShardPrefix(shard) + "snapshot-"
+	snapshots := make(map[string]*Snapshot)
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		listURL := fmt.Sprintf("%s/?%s", strings.TrimRight(endpointURL, "/"), q.Encode())
+		resp, err := http.Get(listURL)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing snapshots: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Error listing snapshots: %s returned %s", endpointURL, resp.Status)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding snapshot list: %v", err)
+		}
+
+		for _, obj := range result.Contents {
+			keyBase, chunk := path.Split(obj.Key)
+			keyBase = strings.TrimSuffix(keyBase, "/")
+			if chunk == "" || path.Dir(keyBase)+"/" != ShardPrefix(shard) {
+				continue
+			}
+			s, ok := snapshots[keyBase]
+			if !ok {
+				ts, err := KeyBaseTimestamp(keyBase)
+				if err != nil {
+					continue
+				}
+				s = &Snapshot{Endpoint: endpointURL, Shard: shard, KeyBase: keyBase, Timestamp: ts}
+				snapshots[keyBase] = s
+			}
+			s.Chunks = append(s.Chunks, chunk)
+			s.Size += obj.Size
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	list := make([]*Snapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		sort.Strings(s.Chunks)
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Timestamp > list[j].Timestamp
+	})
+	return list, nil
+}
+
+// KeyBaseTimestamp extracts the timestamp (in ms) encoded in a key base like
+// FARCASTER_NETWORK_MAINNET/0/snapshot-2025-06-24-1750741283.tar.gz
+func KeyBaseTimestamp(keyBase string) (int, error) {
+	name := strings.TrimSuffix(path.Base(keyBase), ".tar.gz")
+	if !strings.HasPrefix(name, "snapshot-") {
+		return 0, fmt.Errorf("not a snapshot key base: %s", keyBase)
+	}
+	i := strings.LastIndex(name, "-")
+	secs, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("no timestamp in key base %s", keyBase)
+	}
+	return int(secs * 1000), nil
+}
+
+// FindSnapshot picks a snapshot from a list returned by ListSnapshots.
+// The selector is either a full key base, or a timestamp (unix seconds or ms),
+// in which case the newest snapshot not newer than that moment is returned.
+func FindSnapshot(list []*Snapshot, selector string) (*Snapshot, error) {
+	if strings.Contains(selector, "/") {
+		for _, s := range list {
+			if s.KeyBase == strings.TrimSuffix(selector, "/") {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("snapshot %s not found", selector)
+	}
+
+	ts, err := strconv.ParseInt(selector, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot selector %q: expected a key base or a timestamp", selector)
+	}
+	if ts < 1e12 {
+		ts *= 1000
+	}
+	for _, s := range list { // newest first
+		if int64(s.Timestamp) <= ts {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no snapshot at or before %s", time.UnixMilli(ts).UTC().Format(time.RFC3339))
+}
+
+// KeyBaseNetwork returns the network (MAINNET, TESTNET...) a key base belongs to.
+func KeyBaseNetwork(keyBase string) string {
+	network, _, _ := strings.Cut(keyBase, "/")
+	return strings.TrimPrefix(network, "FARCASTER_NETWORK_")
+}
+
+// KeyBaseShard returns the shard id a key base belongs to.
+func KeyBaseShard(keyBase string) (int, error) {
+	parts := strings.Split(keyBase, "/")
+	if len(parts) < 3 {
+		return 0, fmt.Errorf("invalid key base: %s", keyBase)
+	}
+	shard, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid key base: %s", keyBase)
+	}
+	return shard, nil
+}
@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LockFile is created in the download and extraction directories while
+// snapdown writes to them, so that two runs do not write the same files.
+const LockFile = "snapdown.lock"
+
+// LockInfo is what a lock file holds: who holds the lock.
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Command string    `json:"command,omitempty"`
+}
+
+func (l *LockInfo) String() string {
+	if l == nil || l.PID == 0 {
+		return "another snapdown process"
+	}
+	s := fmt.Sprintf("PID %d", l.PID)
+	if l.Command != "" {
+		s = fmt.Sprintf("%q (PID %d)", l.Command, l.PID)
+	}
+	if l.Host != "" {
+		s += " on " + l.Host
+	}
+	if !l.Started.IsZero() {
+		s += fmt.Sprintf(", started %s (%s ago)", l.Started.Local().Format(time.DateTime), time.Since(l.Started).Round(time.Second))
+	}
+	return s
+}
+
+// LockedError is returned by LockDir when another run holds the lock.
+type LockedError struct {
+	Dir    string
+	Holder *LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is in use by %s. Wait for it to finish or stop it; if it is not running anymore, remove %s",
+		e.Dir, e.Holder, filepath.Join(e.Dir, LockFile))
+}
+
+// DirLock is held on a directory until Unlock is called, or the process
+// exits.
+type DirLock struct {
+	path string
+	file *os.File
+	// Stale is set when the lock was taken over from a run that did not
+	// release it.
+	Stale *LockInfo
+}
+
+// LockDir takes the lock of dir, which must exist. It returns a
+// *LockedError if another run holds it.
+func LockDir(dir string) (*DirLock, error) {
+	path := filepath.Join(dir, LockFile)
+	f, stale, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &DirLock{path: path, file: f, Stale: stale}
+	if err := l.write(); err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Unlock releases the lock and removes the lock file.
+func (l *DirLock) Unlock() {
+	if l == nil || l.file == nil {
+		return
+	}
+	releaseFile(l.file, l.path)
+	l.file = nil
+}
+
+func (l *DirLock) write() error {
+	host, _ := os.Hostname()
+	info := LockInfo{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now().UTC(),
+		Command: filepath.Base(os.Args[0]) + " " + strings.Join(os.Args[1:], " "),
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(append(data, '\n'), 0); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// readLockInfo returns what a lock file holds, or nil if it is empty or
+// can not be read.
+func readLockInfo(f *os.File) *LockInfo {
+	data := make([]byte, 4096)
+	n, _ := f.ReadAt(data, 0)
+	var info LockInfo
+	if n == 0 || json.Unmarshal(data[:n], &info) != nil {
+		return nil
+	}
+	return &info
+}
@@ -0,0 +1,57 @@
+//go:build !unix
+
+package downloader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// lockFile creates path, which must not exist. Without flock, a lock
+// file is only known to be stale if it was left by a process of this
+// host that is not running anymore.
+func lockFile(path string) (*os.File, *LockInfo, error) {
+	var stale *LockInfo
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f, stale, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, nil, err
+		}
+		held, err := os.Open(path)
+		if err != nil {
+			continue // released in the meantime
+		}
+		holder := readLockInfo(held)
+		held.Close()
+		host, _ := os.Hostname()
+		if stale != nil || holder == nil || holder.Host != host || processRunning(holder.PID) {
+			return nil, nil, &LockedError{Dir: filepath.Dir(path), Holder: holder}
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, nil, err
+		}
+		stale = holder
+	}
+}
+
+// releaseFile closes the lock file first, open files can not be removed
+// on Windows.
+func releaseFile(f *os.File, path string) {
+	f.Close()
+	os.Remove(path)
+}
+
+func processRunning(pid int) bool {
+	// On Windows, FindProcess fails if there is no such process.
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// lockHolder can not tell if a file is locked without fcntl and flock.
+func lockHolder(path string) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,78 @@
+//go:build unix
+
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile opens path and takes a flock on it. The kernel releases the
+// lock when the process dies, so a lock file that is not locked was left
+// by a run that did not finish: its content is returned as stale.
+func lockFile(path string) (*os.File, *LockInfo, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			holder := readLockInfo(f)
+			f.Close()
+			if err == unix.EWOULDBLOCK {
+				return nil, nil, &LockedError{Dir: filepath.Dir(path), Holder: holder}
+			}
+			return nil, nil, err
+		}
+		// The holder may have removed the file between our open and our
+		// flock, the lock is then on a file nobody else will look at.
+		if sameFile(f, path) {
+			return f, readLockInfo(f), nil
+		}
+		f.Close()
+	}
+}
+
+// releaseFile removes the lock file before it is unlocked: a run that
+// opened it in the meantime sees it is gone once it gets the lock, and
+// creates a new one.
+func releaseFile(f *os.File, path string) {
+	os.Remove(path)
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	f.Close()
+}
+
+func sameFile(f *os.File, path string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, current)
+}
+
+// lockHolder reports if a file is locked, and the PID of the process
+// that holds the lock if it is known. RocksDB uses fcntl locks, flock
+// locks are checked too.
+func lockHolder(path string) (int, bool) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if f, err = os.Open(path); err != nil {
+			return 0, false
+		}
+	}
+	defer f.Close()
+
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_GETLK, &lk); err == nil && lk.Type != unix.F_UNLCK {
+		return int(lk.Pid), true
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err == unix.EWOULDBLOCK {
+		return 0, true
+	} else if err == nil {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	}
+	return 0, false
+}
@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Metadata comes from the bucket, or from a metadata.json that may have
+// been edited, and its chunk names and key base end up in paths and
+// URLs: it is validated before anything is done with it.
+var (
+	chunkNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	keyBasePattern   = regexp.MustCompile(`^FARCASTER_NETWORK_[A-Z0-9_]+/([0-9]+)/snapshot-[A-Za-z0-9._-]+$`)
+)
+
+const (
+	maxChunks = 100000
+	// No snapshot is older than snapchain.
+	minSnapshotTime = 1704067200000 // 2024-01-01T00:00:00Z, in ms
+	// Clocks are not perfectly in sync.
+	maxClockSkew = 24 * time.Hour
+)
+
+// Validate checks that metadata is well-formed and belongs to shard.
+func (m *Metadata) Validate(shard int) error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("invalid metadata for shard %d: %s", shard, fmt.Sprintf(format, args...))
+	}
+	match := keyBasePattern.FindStringSubmatch(m.KeyBase)
+	if match == nil {
+		return invalid("malformed key base %q", m.KeyBase)
+	}
+	if match[1] != fmt.Sprint(shard) {
+		return invalid("key base %s is for shard %s", m.KeyBase, match[1])
+	}
+
+	if len(m.Chunks) == 0 || len(m.Chunks) > maxChunks {
+		return invalid("%d chunks (expected 1 to %d)", len(m.Chunks), maxChunks)
+	}
+	seen := make(map[string]bool, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		if !chunkNamePattern.MatchString(chunk) {
+			return invalid("malformed chunk name %q", chunk)
+		}
+		if seen[chunk] {
+			return invalid("chunk %s is listed twice", chunk)
+		}
+		seen[chunk] = true
+	}
+	if len(m.Sizes) > 0 && len(m.Sizes) != len(m.Chunks) {
+		return invalid("%d sizes for %d chunks", len(m.Sizes), len(m.Chunks))
+	}
+	for i, size := range m.Sizes {
+		if size <= 0 {
+			return invalid("chunk %s has size %d", m.Chunks[i], size)
+		}
+	}
+
+	maxTime := time.Now().Add(maxClockSkew).UnixMilli()
+	if int64(m.Timestamp) < minSnapshotTime || int64(m.Timestamp) > maxTime {
+		return invalid("implausible timestamp %d", m.Timestamp)
+	}
+
+	if m.Endpoint != "" {
+		u, err := url.Parse(m.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalid("malformed endpoint %q", m.Endpoint)
+		}
+	}
+	return nil
+}
+
+// ValidateShardMetadata validates the metadata of every shard, as saved
+// in metadata.json. The shards must all belong to the same network.
+func ValidateShardMetadata(shardMetadata map[int]*Metadata) error {
+	network, networkShard := "", 0
+	for shard, metadata := range shardMetadata {
+		if metadata == nil {
+			return fmt.Errorf("invalid metadata for shard %d: null", shard)
+		}
+		if err := metadata.Validate(shard); err != nil {
+			return err
+		}
+		switch n := KeyBaseNetwork(metadata.KeyBase); {
+		case network == "":
+			network, networkShard = n, shard
+		case n != network:
+			return fmt.Errorf("invalid metadata: shard %d is a %s snapshot, shard %d a %s one", networkShard, network, shard, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validMetadata returns the metadata of a snapshot of shard on network.
+func validMetadata(network string, shard int) *Metadata {
+	return &Metadata{
+		KeyBase:   fmt.Sprintf("FARCASTER_NETWORK_%s/%d/snapshot-2025-06-24-1750741283.tar.gz", network, shard),
+		Chunks:    []string{"chunk_0001.bin", "chunk_0002.bin"},
+		Timestamp: 1750741283000,
+	}
+}
+
+func TestMetadataValidate(t *testing.T) {
+	now := int(time.Now().UnixMilli())
+	for _, c := range []struct {
+		name    string
+		edit    func(m *Metadata)
+		invalid string // part of the error, "" if valid
+	}{
+		{"valid", func(m *Metadata) {}, ""},
+
+		{"chunk name with dots", func(m *Metadata) { m.Chunks[0] = "chunk.0001.tar.gz" }, ""},
+		{"chunk name of 128 characters", func(m *Metadata) { m.Chunks[0] = strings.Repeat("c", 128) }, ""},
+		{"chunk name of 129 characters", func(m *Metadata) { m.Chunks[0] = strings.Repeat("c", 129) }, "malformed chunk name"},
+		{"empty chunk name", func(m *Metadata) { m.Chunks[0] = "" }, "malformed chunk name"},
+		{"chunk name ..", func(m *Metadata) { m.Chunks[0] = ".." }, "malformed chunk name"},
+		{"chunk name with ..", func(m *Metadata) { m.Chunks[0] = "../../.ssh/authorized_keys" }, "malformed chunk name"},
+		{"chunk name with /", func(m *Metadata) { m.Chunks[0] = "shard-1/chunk_0001.bin" }, "malformed chunk name"},
+		{"chunk name with \\", func(m *Metadata) { m.Chunks[0] = `chunk\0001` }, "malformed chunk name"},
+		{"chunk name with a leading dot", func(m *Metadata) { m.Chunks[0] = ".chunk_0001.bin" }, "malformed chunk name"},
+		{"chunk name with a space", func(m *Metadata) { m.Chunks[0] = "chunk 0001" }, "malformed chunk name"},
+		{"chunk listed twice", func(m *Metadata) { m.Chunks[1] = m.Chunks[0] }, "listed twice"},
+		{"no chunks", func(m *Metadata) { m.Chunks = nil }, "0 chunks"},
+		{"too many chunks", func(m *Metadata) { m.Chunks = make([]string, maxChunks+1) }, "chunks (expected 1 to"},
+
+		{"sizes", func(m *Metadata) { m.Sizes = []int64{100, 10} }, ""},
+		{"missing sizes", func(m *Metadata) { m.Sizes = []int64{100} }, "1 sizes for 2 chunks"},
+		{"empty chunk", func(m *Metadata) { m.Sizes = []int64{100, 0} }, "has size 0"},
+		{"negative size", func(m *Metadata) { m.Sizes = []int64{-1, 10} }, "has size -1"},
+
+		{"testnet key base", func(m *Metadata) { *m = *validMetadata("TESTNET", 1) }, ""},
+		{"key base of another shard", func(m *Metadata) { *m = *validMetadata("MAINNET", 2) }, "is for shard 2"},
+		{"key base of shard 11", func(m *Metadata) { *m = *validMetadata("MAINNET", 11) }, "is for shard 11"},
+		{"empty key base", func(m *Metadata) { m.KeyBase = "" }, "malformed key base"},
+		{"key base without network", func(m *Metadata) { m.KeyBase = "1/snapshot-1.tar.gz" }, "malformed key base"},
+		{"key base with a lowercase network", func(m *Metadata) { m.KeyBase = "FARCASTER_NETWORK_mainnet/1/snapshot-1.tar.gz" }, "malformed key base"},
+		{"key base of another bucket", func(m *Metadata) { m.KeyBase = "OTHER_NETWORK_MAINNET/1/snapshot-1.tar.gz" }, "malformed key base"},
+		{"key base with ..", func(m *Metadata) { m.KeyBase = "FARCASTER_NETWORK_MAINNET/1/../../snapshot-1" }, "malformed key base"},
+		{"key base with a trailing /", func(m *Metadata) { m.KeyBase += "/" }, "malformed key base"},
+		{"key base with a leading /", func(m *Metadata) { m.KeyBase = "/" + m.KeyBase }, "malformed key base"},
+
+		{"timestamp of 2024-01-01", func(m *Metadata) { m.Timestamp = minSnapshotTime }, ""},
+		{"timestamp before 2024", func(m *Metadata) { m.Timestamp = minSnapshotTime - 1 }, "implausible timestamp"},
+		{"no timestamp", func(m *Metadata) { m.Timestamp = 0 }, "implausible timestamp"},
+		{"timestamp in seconds", func(m *Metadata) { m.Timestamp = 1750741283 }, "implausible timestamp"},
+		{"timestamp of now", func(m *Metadata) { m.Timestamp = now }, ""},
+		{"timestamp a bit ahead", func(m *Metadata) { m.Timestamp = now + int(time.Hour.Milliseconds()) }, ""},
+		{"timestamp in the future", func(m *Metadata) { m.Timestamp = now + int(2*maxClockSkew.Milliseconds()) }, "implausible timestamp"},
+
+		{"https endpoint", func(m *Metadata) { m.Endpoint = "https://snapshot.farcaster.xyz" }, ""},
+		{"http endpoint with a port", func(m *Metadata) { m.Endpoint = "http://127.0.0.1:8080" }, ""},
+		{"endpoint with another scheme", func(m *Metadata) { m.Endpoint = "file:///etc" }, "malformed endpoint"},
+		{"endpoint without host", func(m *Metadata) { m.Endpoint = "https://" }, "malformed endpoint"},
+		{"endpoint without scheme", func(m *Metadata) { m.Endpoint = "snapshot.farcaster.xyz" }, "malformed endpoint"},
+		{"unparsable endpoint", func(m *Metadata) { m.Endpoint = "https://snap shot\x7f" }, "malformed endpoint"},
+	} {
+		m := validMetadata("MAINNET", 1)
+		c.edit(m)
+		err := m.Validate(1)
+		switch {
+		case c.invalid == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.invalid != "" && err == nil:
+			t.Errorf("%s: valid", c.name)
+		case err != nil && !strings.Contains(err.Error(), c.invalid):
+			t.Errorf("%s: got %q, expected %q in it", c.name, err, c.invalid)
+		}
+	}
+}
+
+func TestValidateShardMetadata(t *testing.T) {
+	invalidChunk := validMetadata("MAINNET", 1)
+	invalidChunk.Chunks[1] = "../chunk"
+	for _, c := range []struct {
+		name     string
+		metadata map[int]*Metadata
+		invalid  string
+	}{
+		{"empty", map[int]*Metadata{}, ""},
+		{"one shard", map[int]*Metadata{1: validMetadata("MAINNET", 1)}, ""},
+		{"all shards", map[int]*Metadata{0: validMetadata("TESTNET", 0), 1: validMetadata("TESTNET", 1), 2: validMetadata("TESTNET", 2)}, ""},
+		{"null", map[int]*Metadata{0: validMetadata("MAINNET", 0), 1: nil}, "shard 1: null"},
+		{"shards swapped", map[int]*Metadata{1: validMetadata("MAINNET", 2), 2: validMetadata("MAINNET", 1)}, "is for shard"},
+		{"invalid chunk", map[int]*Metadata{0: validMetadata("MAINNET", 0), 1: invalidChunk}, "malformed chunk name"},
+		{"mixed networks", map[int]*Metadata{1: validMetadata("MAINNET", 1), 2: validMetadata("TESTNET", 2)}, "snapshot, shard"},
+	} {
+		err := ValidateShardMetadata(c.metadata)
+		switch {
+		case c.invalid == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.invalid != "" && err == nil:
+			t.Errorf("%s: valid", c.name)
+		case err != nil && !strings.Contains(err.Error(), c.invalid):
+			t.Errorf("%s: got %q, expected %q in it", c.name, err, c.invalid)
+		}
+	}
+}
+
+func TestShardMetadata(t *testing.T) {
+	latest := map[string]*Metadata{
+		"/FARCASTER_NETWORK_MAINNET/1/latest.json": validMetadata("MAINNET", 1),
+		"/FARCASTER_NETWORK_MAINNET/2/latest.json": validMetadata("MAINNET", 1),
+		"/FARCASTER_NETWORK_MAINNET/3/latest.json": validMetadata("TESTNET", 3),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := latest[r.URL.Path]; m != nil {
+			json.NewEncoder(w).Encode(m)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	m, err := ShardMetadata(server.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Endpoint != server.URL {
+		t.Errorf("got endpoint %q, expected %q", m.Endpoint, server.URL)
+	}
+	for shard, invalid := range map[int]string{2: "is for shard 1", 3: "is for TESTNET, not MAINNET"} {
+		if _, err := ShardMetadata(server.URL, shard); err == nil || !strings.Contains(err.Error(), invalid) {
+			t.Errorf("shard %d: got %v, expected %q in the error", shard, err, invalid)
+		}
+	}
+}
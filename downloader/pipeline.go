@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// ChunkTracker lets extraction follow a download in progress. It records
+// the chunks Download has completed, and provides ChunkSources that wait
+// for each chunk before opening it.
+type ChunkTracker struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	done    map[string]error
+	aborted error
+}
+
+func NewChunkTracker() *ChunkTracker {
+	t := &ChunkTracker{done: make(map[string]error)}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+func chunkKey(shard int, chunk string) string {
+	return fmt.Sprintf("%d/%s", shard, chunk)
+}
+
+// ChunkDone records that a chunk has been downloaded, or has failed.
+// It can be used as Download's ChunkDone hook.
+func (t *ChunkTracker) ChunkDone(shard int, chunk string, err error) {
+	t.mu.Lock()
+	t.done[chunkKey(shard, chunk)] = err
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+// Abort makes all waits for chunks that are not complete yet fail with err.
+// It is called when the download is over, so that the extraction does not
+// wait forever for chunks that will never come.
+func (t *ChunkTracker) Abort(err error) {
+	t.mu.Lock()
+	if t.aborted == nil {
+		t.aborted = err
+	}
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+func (t *ChunkTracker) wait(shard int, chunk string) error {
+	key := chunkKey(shard, chunk)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if err, ok := t.done[key]; ok {
+			if err != nil {
+				return fmt.Errorf("chunk %s failed to download: %v", chunk, err)
+			}
+			return nil
+		}
+		if t.aborted != nil {
+			return fmt.Errorf("chunk %s: %v", chunk, t.aborted)
+		}
+		t.cond.Wait()
+	}
+}
+
+// Chunks returns the chunks of a shard listed in metadata, as a ChunkSource
+// that waits for each chunk to be downloaded before opening it.
+func (t *ChunkTracker) Chunks(rootDir string, shard int, metadata *Metadata) ChunkSource {
+	return &trackedChunks{
+		tracker: t,
+		shard:   shard,
+		dir:     filepath.Join(rootDir, fmt.Sprintf("shard-%d", shard)),
+		chunks:  metadata.Chunks,
+		index:   IndexPath(rootDir, shard),
+		dels:    loadDeletions(rootDir, shard),
+	}
+}
+
+type trackedChunks struct {
+	tracker *ChunkTracker
+	shard   int
+	dir     string
+	chunks  []string
+	index   string
+	dels    *deletions
+}
+
+func (c *trackedChunks) IndexPath() string {
+	return c.index
+}
+
+func (c *trackedChunks) Len() int {
+	return len(c.chunks)
+}
+
+func (c *trackedChunks) Open(i int) (io.ReadCloser, error) {
+	if err := c.tracker.wait(c.shard, c.chunks[i]); err != nil {
+		return nil, err
+	}
+	return c.dels.open(c.chunkPath(i))
+}
+
+func (c *trackedChunks) chunkPath(i int) string {
+	return filepath.Join(c.dir, c.chunks[i])
+}
+
+func (c *trackedChunks) deleted() *deletions {
+	return c.dels
+}
@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ProvenanceFile is written in every extracted shard directory, and in
+// the extraction root, and records the snapshot the data came from.
+const ProvenanceFile = "snapdown.json"
+
+type Provenance struct {
+	KeyBase     string    `json:"key_base,omitempty"`
+	Timestamp   int       `json:"timestamp,omitempty"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Network     string    `json:"network,omitempty"`
+	Version     string    `json:"snapdown_version"`
+	ExtractedAt time.Time `json:"extracted_at"`
+	Chunks      int       `json:"chunks"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	// Shards is only set in the extraction root, and holds a copy
+	// of each shard's provenance.
+	Shards map[int]*Provenance `json:"shards,omitempty"`
+}
+
+// NewProvenance returns the provenance record of a successful shard extraction.
+// metadata may be nil if the chunks were not downloaded by snapdown.
+func NewProvenance(metadata *Metadata, result ExtractResult, version string) *Provenance {
+	p := &Provenance{
+		Version:     version,
+		ExtractedAt: time.Now().UTC(),
+		Chunks:      result.Chunks,
+		BytesIn:     result.BytesIn,
+		BytesOut:    result.BytesOut,
+	}
+	if metadata != nil {
+		p.KeyBase = metadata.KeyBase
+		p.Timestamp = metadata.Timestamp
+		p.Endpoint = metadata.Endpoint
+		p.Network = KeyBaseNetwork(metadata.KeyBase)
+	}
+	return p
+}
+
+// ShardDir returns the directory a shard is extracted to.
+func ShardDir(dstDir string, shard int) string {
+	return filepath.Join(dstDir, fmt.Sprintf("shard-%d", shard))
+}
+
+func WriteProvenance(dir string, p *Provenance) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ReplaceFile(filepath.Join(dir, ProvenanceFile), data)
+}
+
+// ReadProvenance reads the provenance record of an extracted directory.
+// It returns an error satisfying os.IsNotExist if there is none.
+func ReadProvenance(dir string) (*Provenance, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ProvenanceFile))
+	if err != nil {
+		return nil, err
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", filepath.Join(dir, ProvenanceFile), err)
+	}
+	return &p, nil
+}
+
+// rootMu serializes the updates of the summary in the extraction root,
+// shards can be extracted in parallel.
+var rootMu sync.Mutex
+
+// RecordProvenance writes the provenance of a freshly extracted shard in
+// its directory, and updates the summary in the extraction root, keeping
+// the entries of shards that were not extracted this time.
+func RecordProvenance(dstDir string, shard int, p *Provenance) error {
+	if err := WriteProvenance(ShardDir(dstDir, shard), p); err != nil {
+		return err
+	}
+
+	rootMu.Lock()
+	defer rootMu.Unlock()
+	root, err := ReadProvenance(dstDir)
+	if err != nil || root.Shards == nil {
+		root = &Provenance{Shards: make(map[int]*Provenance)}
+	}
+	root.Shards[shard] = p
+	summarize(root, p)
+	return WriteProvenance(dstDir, root)
+}
+
+// ClearProvenance removes the provenance of a shard that is about to be
+// overwritten in place, so that a shard whose extraction did not complete
+// is not taken for the snapshot it replaces. The removal is synced
+// whatever Fsync says: it is what tells a damaged shard after a crash.
+func ClearProvenance(dstDir string, shard int) error {
+	dir := ShardDir(dstDir, shard)
+	err := os.Remove(filepath.Join(dir, ProvenanceFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	rootMu.Lock()
+	defer rootMu.Unlock()
+	root, err := ReadProvenance(dstDir)
+	if err != nil || root.Shards[shard] == nil {
+		return nil
+	}
+	delete(root.Shards, shard)
+	summarize(root, nil)
+	return WriteProvenance(dstDir, root)
+}
+
+// summarize updates the totals of the summary in the extraction root, and
+// what comes from the last extraction p, if there is one.
+func summarize(root, p *Provenance) {
+	if p != nil {
+		root.Version = p.Version
+		root.ExtractedAt = p.ExtractedAt
+		root.Endpoint = p.Endpoint
+		root.Network = p.Network
+	}
+	root.Chunks, root.BytesIn, root.BytesOut = 0, 0, 0
+	for _, s := range root.Shards {
+		root.Chunks += s.Chunks
+		root.BytesIn += s.BytesIn
+		root.BytesOut += s.BytesOut
+	}
+}
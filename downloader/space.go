@@ -0,0 +1,233 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SpaceNeed is the disk space that a download or an extraction still
+// needs in Dir.
+type SpaceNeed struct {
+	Dir    string
+	What   string
+	Shard  int
+	Bytes  int64
+	Inodes int64
+	// Basis says how Bytes was computed.
+	Basis string
+	// Archive is the size of the chunks, for an extraction.
+	Archive int64
+}
+
+// DiskSpace is what is left on a filesystem, see DiskFree.
+type DiskSpace struct {
+	// Device identifies the filesystem.
+	Device uint64
+	// Free is the space available to unprivileged users.
+	Free int64
+	// FreeInodes is -1 if the filesystem does not have a fixed number
+	// of inodes.
+	FreeInodes int64
+}
+
+// Extracted files whose size is not known are assumed to be this big on
+// average to estimate the inodes they need. RocksDB files are larger.
+const estimatedFileSize = 4 << 20
+
+// DownloadSpace returns the space needed to download the chunks of a
+// shard that are not (completely) in rootDir. Chunks all have the size of
+// the first one except the last one, so only these two are asked for.
+func DownloadSpace(rootDir string, shard int, metadata *Metadata) (SpaceNeed, error) {
+	need := SpaceNeed{Dir: rootDir, What: "download", Shard: shard, Basis: "chunk sizes"}
+	chunkSize, lastSize, err := remoteChunkSizes(metadata)
+	if err != nil {
+		return need, err
+	}
+	srcDir := filepath.Join(rootDir, fmt.Sprintf("shard-%d", shard))
+	deleted := loadDeletions(rootDir, shard)
+	for i, chunk := range metadata.Chunks {
+		size := chunkSize
+		if i == len(metadata.Chunks)-1 {
+			size = lastSize
+		}
+		if _, ok := deleted.size(chunk); ok {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(srcDir, chunk))
+		if err != nil {
+			need.Bytes += size
+			need.Inodes++
+			continue
+		}
+		need.Bytes += max(0, size-info.Size())
+	}
+	return need, nil
+}
+
+// ExtractSpace returns the space needed to extract a shard into dir,
+// the directory its files are written to. Its size is taken from the
+// index of the shard if there is one, from the size that gzip records at
+// the end of the archive otherwise, or estimated with ExtractRatio. The
+// archive is read in rootDir, or on the server if it is not there yet.
+// Files already in dir are assumed to be replaced.
+func ExtractSpace(rootDir string, shard int, metadata *Metadata, dir string) (SpaceNeed, error) {
+	need := SpaceNeed{Dir: dir, What: "extraction", Shard: shard}
+	archive, err := localArchive(rootDir, shard)
+	if err != nil && metadata != nil && EndpointURL != "" {
+		archive, err = remoteArchive(metadata)
+	}
+	if err != nil {
+		return need, err
+	}
+
+	need.Archive = archive.size
+	index, err := ReadIndex(IndexPath(rootDir, shard))
+	format, _ := formatOf(archive.head)
+	switch {
+	case err == nil && index.Head == crc32.ChecksumIEEE(archive.head):
+		for _, e := range index.Entries {
+			need.Bytes += e.Size
+		}
+		need.Inodes = int64(len(index.Entries))
+		need.Basis = "index"
+	case format == FormatTar:
+		need.Bytes = archive.size
+		need.Basis = "archive size"
+	case format == FormatGzip && len(archive.tail) == 4:
+		isize := binary.LittleEndian.Uint32(archive.tail)
+		need.Bytes = fromISize(isize, int64(float64(archive.size)*ExtractRatio))
+		need.Basis = "gzip size"
+	default:
+		need.Bytes = int64(float64(archive.size) * ExtractRatio)
+		need.Basis = fmt.Sprintf("compressed size x%.2f", ExtractRatio)
+	}
+	if need.Basis != "index" {
+		need.Inodes = need.Bytes/estimatedFileSize + 1
+	}
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			need.Bytes -= info.Size()
+		}
+		need.Inodes--
+		return nil
+	})
+	need.Bytes = max(0, need.Bytes)
+	need.Inodes = max(0, need.Inodes)
+	return need, nil
+}
+
+// fromISize returns the size of a gzip stream whose size modulo 4GB is
+// isize (what gzip records), that is the closest to estimate.
+func fromISize(isize uint32, estimate int64) int64 {
+	const wrap = 1 << 32
+	wraps := max(0, (estimate-int64(isize)+wrap/2)/wrap)
+	return int64(isize) + wraps*wrap
+}
+
+// archiveEnds is the start and the end of a shard's archive.
+type archiveEnds struct {
+	size int64
+	head []byte // 512 bytes, or less if the first chunk is smaller
+	tail []byte // 4 bytes
+}
+
+func localArchive(rootDir string, shard int) (*archiveEnds, error) {
+	src, err := DirChunks(rootDir, shard)
+	if err != nil {
+		return nil, err
+	}
+	files := src.(*fileChunks)
+	archive := &archiveEnds{}
+	for i := range files.files {
+		size, err := chunkSize(files, i)
+		if err != nil {
+			return nil, err
+		}
+		archive.size += size
+	}
+	if archive.head, err = readAt(files.files[0], 0, 512); err != nil {
+		return nil, err
+	}
+	// The last chunk may have been deleted, see DeleteConsumedChunks
+	last := files.files[len(files.files)-1]
+	if info, err := os.Stat(last); err == nil && info.Size() >= 4 {
+		archive.tail, err = readAt(last, info.Size()-4, 4)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+func readAt(path string, offset int64, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	read, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:read], nil
+}
+
+func remoteArchive(metadata *Metadata) (*archiveEnds, error) {
+	chunkSize, lastSize, err := remoteChunkSizes(metadata)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := fmt.Sprintf("%s/%s", EndpointURL, metadata.KeyBase)
+	archive := &archiveEnds{size: chunkSize*int64(len(metadata.Chunks)-1) + lastSize}
+	if archive.head, err = fetchRange(fmt.Sprintf("%s/%s", baseURL, metadata.Chunks[0]), "bytes=0-511"); err != nil {
+		return nil, err
+	}
+	if lastSize >= 4 {
+		// Without it, the size is estimated from the compressed size.
+		archive.tail, _ = fetchRange(fmt.Sprintf("%s/%s", baseURL, metadata.Chunks[len(metadata.Chunks)-1]), "bytes=-4")
+	}
+	return archive, nil
+}
+
+// remoteChunkSizes returns the size of the first and of the last chunk
+// of a shard.
+func remoteChunkSizes(metadata *Metadata) (int64, int64, error) {
+	baseURL := fmt.Sprintf("%s/%s", EndpointURL, metadata.KeyBase)
+	chunkSize, err := ChunkSize(fmt.Sprintf("%s/%s", baseURL, metadata.Chunks[0]))
+	if err != nil || len(metadata.Chunks) == 1 {
+		return chunkSize, chunkSize, err
+	}
+	lastSize, err := ChunkSize(fmt.Sprintf("%s/%s", baseURL, metadata.Chunks[len(metadata.Chunks)-1]))
+	return chunkSize, lastSize, err
+}
+
+func fetchRange(url, byteRange string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", byteRange)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Servers that ignore ranges send the whole file: its start is fine.
+	fromStart := strings.HasPrefix(byteRange, "bytes=0-") && resp.StatusCode == http.StatusOK
+	if resp.StatusCode != http.StatusPartialContent && !fromStart {
+		return nil, fmt.Errorf("GET %s (%s): %s", url, byteRange, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 512))
+}
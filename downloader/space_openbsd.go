@@ -0,0 +1,16 @@
+package downloader
+
+import "golang.org/x/sys/unix"
+
+func statfs(dir string) (fsStats, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return fsStats{}, err
+	}
+	return fsStats{
+		blockSize:  uint64(fs.F_bsize),
+		avail:      uint64(fs.F_bavail),
+		inodes:     uint64(fs.F_files),
+		freeInodes: uint64(fs.F_ffree),
+	}, nil
+}
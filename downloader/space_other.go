@@ -0,0 +1,10 @@
+//go:build !unix
+
+package downloader
+
+import "errors"
+
+// DiskFree can only tell the free space of a filesystem on Unix.
+func DiskFree(dir string) (DiskSpace, error) {
+	return DiskSpace{}, errors.ErrUnsupported
+}
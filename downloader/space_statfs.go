@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly || aix
+
+package downloader
+
+import "golang.org/x/sys/unix"
+
+func statfs(dir string) (fsStats, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return fsStats{}, err
+	}
+	return fsStats{
+		blockSize:  uint64(fs.Bsize),
+		avail:      uint64(fs.Bavail),
+		inodes:     uint64(fs.Files),
+		freeInodes: uint64(fs.Ffree),
+	}, nil
+}
@@ -0,0 +1,19 @@
+//go:build netbsd || solaris
+
+package downloader
+
+import "golang.org/x/sys/unix"
+
+// These systems only have statvfs, that counts blocks in fragments.
+func statfs(dir string) (fsStats, error) {
+	var fs unix.Statvfs_t
+	if err := unix.Statvfs(dir, &fs); err != nil {
+		return fsStats{}, err
+	}
+	return fsStats{
+		blockSize:  uint64(fs.Frsize),
+		avail:      uint64(fs.Bavail),
+		inodes:     uint64(fs.Files),
+		freeInodes: uint64(fs.Ffree),
+	}, nil
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// DiskFree returns the space left on the filesystem of dir. If dir does
+// not exist yet, the filesystem of its closest existing parent is used.
+func DiskFree(dir string) (DiskSpace, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return DiskSpace{}, &os.PathError{Op: "stat", Path: dir, Err: err}
+	}
+	fs, err := statfs(dir)
+	if err != nil {
+		return DiskSpace{}, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	space := DiskSpace{
+		Device:     uint64(st.Dev),
+		Free:       int64(fs.avail * fs.blockSize),
+		FreeInodes: int64(fs.freeInodes),
+	}
+	// btrfs and others allocate inodes as needed, and report none.
+	if fs.inodes == 0 {
+		space.FreeInodes = -1
+	}
+	return space, nil
+}
+
+// fsStats is what DiskFree needs from statfs, whose fields have other
+// names and types from one system to the other.
+type fsStats struct {
+	blockSize  uint64 // the unit of avail
+	avail      uint64 // blocks available to unprivileged users
+	inodes     uint64
+	freeInodes uint64
+}
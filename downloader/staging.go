@@ -0,0 +1,188 @@
+package downloader
+
+/*
+Staged extraction.
+
+A shard is extracted next to the one the node uses, and replaces it
+only once it is complete, so that a failed extraction does not leave
+a mix of old and new files:
+
+	<dst>/shard-N                     the database the node uses
+	<dst>/.shard-N.staging/shard-N    the new one, being extracted
+	<dst>/.shard-N.staging/previous   the old one, during a swap
+	<dst>/shard-N.previous            the old one, with --keep-previous
+
+Where the system can exchange two directories atomically, the old and
+the new shard directories are exchanged. Elsewhere, the old one is
+moved to previous, then the new one to shard-N: if this is interrupted,
+PrepareStaging finishes the swap on the next run. The new shard directory
+holds SwapMarker during the swap, so that PrepareStaging can tell which
+directory is the old one after an exchange.
+
+The new shard is synced to disk before the swap (see Fsync), so that a
+crash after it does not leave a shard directory with missing data.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SwapMarker is in the new shard directory while it is swapped into place.
+const SwapMarker = "snapdown.swapping"
+
+// StagingDir returns the directory a shard is extracted to, before it
+// replaces ShardDir(dstDir, shard).
+func StagingDir(dstDir string, shard int) string {
+	return filepath.Join(dstDir, fmt.Sprintf(".shard-%d.staging", shard))
+}
+
+// PreviousDir returns where the replaced shard directory is kept.
+func PreviousDir(dstDir string, shard int) string {
+	return ShardDir(dstDir, shard) + ".previous"
+}
+
+// PrepareStaging makes StagingDir ready for an extraction. It finishes
+// a swap interrupted by a crash, in which case it returns true and the
+// previous database is left in PreviousDir, and it removes whatever an
+// extraction that can not be resumed left there.
+func PrepareStaging(dstDir string, shard int) (bool, error) {
+	staging := StagingDir(dstDir, shard)
+	shardDir := ShardDir(dstDir, shard)
+	staged := ShardDir(staging, shard)
+	previous := filepath.Join(staging, "previous")
+
+	if exists(filepath.Join(shardDir, SwapMarker)) && exists(staged) && !exists(previous) {
+		// The directories were exchanged: staged is the old shard directory.
+		if err := os.Rename(staged, previous); err != nil {
+			return false, err
+		}
+	}
+	recovered := false
+	if exists(previous) {
+		if !exists(shardDir) {
+			// The new shard was verified before the swap started.
+			if err := os.Rename(staged, shardDir); err != nil {
+				return false, err
+			}
+			if err := syncParent(shardDir); err != nil {
+				return false, err
+			}
+		}
+		if err := keepPrevious(previous, dstDir, shard); err != nil {
+			return false, err
+		}
+		recovered = true
+	}
+	for _, dir := range []string{shardDir, staged} {
+		if err := os.Remove(filepath.Join(dir, SwapMarker)); err != nil && !os.IsNotExist(err) {
+			return recovered, err
+		}
+	}
+	if !hasCheckpoint(staging, shard) {
+		if err := os.RemoveAll(staging); err != nil {
+			return recovered, err
+		}
+	}
+	return recovered, nil
+}
+
+// SwapShard syncs and verifies the shard extracted in StagingDir, and
+// puts it in place of ShardDir(dstDir, shard). The directory it replaces is moved
+// to PreviousDir if keep is set, and removed otherwise.
+func SwapShard(dstDir string, shard int, keep bool) error {
+	staging := StagingDir(dstDir, shard)
+	shardDir := ShardDir(dstDir, shard)
+	staged := ShardDir(staging, shard)
+	previous := filepath.Join(staging, "previous")
+
+	if err := SyncTree(staged); err != nil {
+		return fmt.Errorf("shard %d: not replacing %s: %v", shard, shardDir, err)
+	}
+	if err := VerifyShard(staged); err != nil {
+		return fmt.Errorf("shard %d: not replacing %s: %v", shard, shardDir, err)
+	}
+	if err := ReplaceFile(filepath.Join(staged, SwapMarker), nil); err != nil {
+		return err
+	}
+	switch {
+	case !exists(shardDir):
+		if err := os.Rename(staged, shardDir); err != nil {
+			return err
+		}
+	case exchangeDirs(staged, shardDir) == nil:
+		// staged is now the old shard directory
+		if err := os.Rename(staged, previous); err != nil {
+			return err
+		}
+	default:
+		if err := os.Rename(shardDir, previous); err != nil {
+			return err
+		}
+		if err := os.Rename(staged, shardDir); err != nil {
+			return err
+		}
+	}
+	if err := syncParent(shardDir); err != nil {
+		return err
+	}
+	if err := syncParent(previous); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(shardDir, SwapMarker)); err != nil {
+		return err
+	}
+	if exists(previous) {
+		if keep {
+			if err := keepPrevious(previous, dstDir, shard); err != nil {
+				return err
+			}
+		} else if err := os.RemoveAll(previous); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(staging)
+}
+
+func keepPrevious(previous, dstDir string, shard int) error {
+	if err := os.RemoveAll(PreviousDir(dstDir, shard)); err != nil {
+		return err
+	}
+	return os.Rename(previous, PreviousDir(dstDir, shard))
+}
+
+// VerifyShard checks that an extracted shard directory holds a RocksDB
+// database that can be opened: its CURRENT file names a MANIFEST that
+// exists.
+func VerifyShard(dir string) error {
+	f, err := os.Open(filepath.Join(dir, "CURRENT"))
+	if os.IsNotExist(err) {
+		return errors.New("no CURRENT file, this is not a RocksDB database")
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, err := bufio.NewReader(f).ReadString('\n')
+	manifest = strings.TrimSpace(manifest)
+	if err != nil || !strings.HasPrefix(manifest, "MANIFEST-") || strings.ContainsAny(manifest, `/\`) {
+		return errors.New("invalid CURRENT file")
+	}
+	info, err := os.Stat(filepath.Join(dir, manifest))
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return fmt.Errorf("%s is empty", manifest)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
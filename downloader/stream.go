@@ -0,0 +1,278 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StreamChunks is a ChunkSource that downloads chunks straight into memory,
+// without writing them to disk. Up to jobs chunks are fetched in parallel,
+// in order, ahead of the extractor, as long as they fit in budget bytes.
+// A failed chunk is retried before the extractor reaches it.
+type StreamChunks struct {
+	shard   int
+	baseURL string
+	chunks  []string
+	jobs    int
+	budget  int64
+	retries int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	started  bool
+	ahead    bool // chunks after the one opened are fetched
+	slots    []streamSlot
+	sizes    []int64 // chunk sizes, as far as ChunkSize was asked
+	next     int     // next chunk to fetch
+	consumed int     // chunks handed to the extractor
+	fetching int     // fetches in flight
+	used     int64   // bytes held in memory, or reserved for fetches in flight
+	estimate int64   // expected chunk size, 0 until it is known
+	closed   bool
+}
+
+type streamSlot struct {
+	data []byte
+	err  error
+	done bool
+}
+
+func NewStreamChunks(shard int, metadata *Metadata, jobs int, budget int64, retries int) *StreamChunks {
+	s := &StreamChunks{
+		shard:   shard,
+		baseURL: fmt.Sprintf("%s/%s", EndpointURL, metadata.KeyBase),
+		chunks:  metadata.Chunks,
+		jobs:    max(jobs, 1),
+		budget:  budget,
+		retries: retries,
+		slots:   make([]streamSlot, len(metadata.Chunks)),
+		sizes:   make([]int64, len(metadata.Chunks)),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *StreamChunks) Len() int {
+	return len(s.chunks)
+}
+
+// Open waits for chunk i to be in memory, and returns it. Chunks must be
+// opened in order, and closed before the next one is opened: closing
+// releases its memory. Chunks can be skipped (to resume an extraction):
+// the chunks before the one opened are not fetched.
+//
+// The first chunk is opened to detect the format of the shard before the
+// extractor knows where it resumes, so opening it first only fetches it.
+// Chunks are fetched ahead once another chunk is opened, or after
+// Prefetch.
+func (s *StreamChunks) Open(i int) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ahead = s.ahead || s.started || i > 0
+	s.consumed = i
+	for ; s.next < i; s.next++ {
+		// Skipped without being fetched, they are downloaded as far as
+		// the progress of the download is concerned.
+		size := s.sizes[s.next]
+		sendProgressUpdate(ProgressChan, ProgressUpdate{
+			Shard: s.shard, ChunkName: s.chunks[s.next],
+			BytesDownloaded: size, BytesTotal: size,
+			Done: true})
+	}
+	for j := range s.slots[:i] {
+		s.used -= int64(len(s.slots[j].data))
+		s.slots[j].data = nil
+	}
+	s.start()
+	s.cond.Broadcast()
+	for !s.slots[i].done {
+		s.cond.Wait()
+	}
+	if s.slots[i].err != nil {
+		return nil, s.slots[i].err
+	}
+	return &streamChunk{Reader: bytes.NewReader(s.slots[i].data), s: s, i: i}, nil
+}
+
+// Close stops fetching chunks.
+func (s *StreamChunks) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return nil
+}
+
+// Prefetch starts fetching the chunks after the one opened.
+func (s *StreamChunks) Prefetch() {
+	s.mu.Lock()
+	s.ahead = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// ChunkSize returns the size of chunk i, without fetching it.
+func (s *StreamChunks) ChunkSize(i int) (int64, error) {
+	size, err := ChunkSize(fmt.Sprintf("%s/%s", s.baseURL, s.chunks[i]))
+	if err == nil {
+		s.mu.Lock()
+		s.sizes[i] = size
+		s.mu.Unlock()
+	}
+	return size, err
+}
+
+// start starts the workers, with s.mu held. The size of the chunks is
+// asked for in the background: chunks have the same size, except the
+// last one, and until it is known (or a chunk is fetched) reserve only
+// lets one chunk be fetched at a time.
+func (s *StreamChunks) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	go func() {
+		size, err := ChunkSize(fmt.Sprintf("%s/%s", s.baseURL, s.chunks[0]))
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.sizes[0] = size
+		if s.estimate == 0 {
+			s.estimate = size
+		}
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}()
+	for i := 0; i < s.jobs; i++ {
+		go s.worker()
+	}
+}
+
+// reserve picks the next chunk to fetch, waiting until it fits in the
+// memory budget. The chunk the extractor waits for is always allowed,
+// the others once chunks are fetched ahead. Until the size of the chunks
+// is known, only one is fetched at a time, as the budget can not tell
+// how many fit.
+// It returns the chunk index, and the number of bytes reserved for it.
+func (s *StreamChunks) reserve() (int, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed || s.next >= len(s.chunks) {
+			return 0, 0, false
+		}
+		unknown := s.estimate == 0 && s.fetching > 0
+		if s.next == s.consumed || s.ahead && !unknown && s.used+s.estimate <= s.budget {
+			i := s.next
+			s.next++
+			s.fetching++
+			s.used += s.estimate
+			return i, s.estimate, true
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *StreamChunks) worker() {
+	buf := make([]byte, 128*1024)
+	for {
+		i, reserved, ok := s.reserve()
+		if !ok {
+			return
+		}
+		url := fmt.Sprintf("%s/%s", s.baseURL, s.chunks[i])
+		var (
+			data []byte
+			err  error
+		)
+		for attempt := 0; attempt <= s.retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if data, err = s.fetch(url, s.chunks[i], buf); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("shard=%d, url=%s, error=%v", s.shard, url, err)
+			sendProgressUpdate(ProgressChan, ProgressUpdate{Error: err})
+		}
+
+		s.mu.Lock()
+		s.fetching--
+		if i < s.consumed {
+			data = nil // skipped
+		}
+		s.used += int64(len(data)) - reserved
+		if s.estimate == 0 {
+			s.estimate = int64(len(data))
+		}
+		s.slots[i] = streamSlot{data: data, err: err, done: true}
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+func (s *StreamChunks) fetch(url, chunkName string, buf []byte) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("http get failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http get failed: %s", resp.Status)
+	}
+	total := resp.ContentLength
+	if total <= 0 {
+		return nil, fmt.Errorf("invalid content length: %d", total)
+	}
+
+	const progressStep = 1 * 1024 * 1024
+	data := make([]byte, 0, total)
+	var lastReported int64
+	for {
+		n, err := resp.Body.Read(buf)
+		data = append(data, buf[:n]...)
+		downloaded := int64(len(data))
+		if n > 0 && (downloaded-lastReported >= progressStep || downloaded == total) {
+			sendProgressUpdate(ProgressChan, ProgressUpdate{
+				Shard: s.shard, ChunkName: chunkName,
+				BytesDownloaded: downloaded,
+				BytesTotal:      total,
+				Done:            downloaded == total,
+			})
+			lastReported = downloaded
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read failed: %w", err)
+		}
+	}
+	if int64(len(data)) != total {
+		return nil, fmt.Errorf("short read: %d of %d bytes", len(data), total)
+	}
+	return data, nil
+}
+
+// streamChunk releases the memory of a chunk once it has been read.
+type streamChunk struct {
+	*bytes.Reader
+	s *StreamChunks
+	i int
+}
+
+func (c *streamChunk) Close() error {
+	c.s.mu.Lock()
+	c.s.used -= int64(len(c.s.slots[c.i].data))
+	c.s.slots[c.i].data = nil
+	c.s.mu.Unlock()
+	c.s.cond.Broadcast()
+	return nil
+}
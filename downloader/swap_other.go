@@ -0,0 +1,11 @@
+//go:build !linux
+
+package downloader
+
+import "errors"
+
+// exchangeDirs is only supported on Linux, SwapShard falls back to
+// two renames.
+func exchangeDirs(a, b string) error {
+	return errors.New("exchanging directories is not supported")
+}
@@ -0,0 +1,134 @@
+package downloader
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Tar flavours. They differ in the options they know (see extractArgs),
+// and in what they print while extracting.
+const (
+	TarGNU     = "GNU tar"
+	TarBSD     = "bsdtar"
+	TarBusyBox = "BusyBox tar"
+	TarUnknown = "tar"
+)
+
+// TarBinary is a tar found on the system, see DetectTar.
+type TarBinary struct {
+	Path    string
+	Flavour string
+	Version string
+}
+
+func (t *TarBinary) String() string {
+	if t.Version == "" {
+		return fmt.Sprintf("%s (%s)", t.Flavour, t.Path)
+	}
+	return fmt.Sprintf("%s %s (%s)", t.Flavour, t.Version, t.Path)
+}
+
+// extractArgs returns the arguments that make tar extract its stdin
+// into dstDir, listing the files it extracts. Files are not given the
+// owner they have in the archive, even when tar runs as root, like the Go
+// extractor does; GNU tar also prints the number of bytes it read once
+// it is done. A tar of unknown flavour is only given the options every
+// tar knows.
+func (t *TarBinary) extractArgs(dstDir string, extra []string) []string {
+	args := []string{"-x", "-v", "-f", "-", "-C", dstDir}
+	switch t.Flavour {
+	case TarGNU:
+		args = append(args, "--no-same-owner", "--totals")
+	case TarBSD:
+		args = append(args, "--no-same-owner")
+	case TarBusyBox:
+		args = append(args, "-o")
+	}
+	return append(args, extra...)
+}
+
+// listsOnStderr reports if the files extracted are listed on stderr
+// (prefixed with "x ") rather than on stdout.
+func (t *TarBinary) listsOnStderr() bool {
+	return t.Flavour == TarBSD || t.Flavour == TarUnknown
+}
+
+var tarVersion = regexp.MustCompile(`v?(\d+(\.\d+)+)`)
+
+// DetectTar finds the tar called path ("tar" in PATH if empty), and
+// checks that it can extract a tar archive from its stdin with the
+// arguments of its flavour. It returns an error that says why the tar can
+// not be used.
+//
+// tar is always given an uncompressed archive (snapdown decompresses it,
+// see decompress.go), so whether it can call gzip does not matter.
+func DetectTar(path string) (*TarBinary, error) {
+	if path == "" {
+		path = "tar"
+	}
+	found, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' not found: %v", path, err)
+	}
+	t := &TarBinary{Path: found, Flavour: TarUnknown}
+
+	// BusyBox does not know --version, and prints its usage instead.
+	out, _ := exec.Command(found, "--version").CombinedOutput()
+	version := string(out)
+	switch {
+	case strings.Contains(version, "GNU tar"):
+		t.Flavour = TarGNU
+	case strings.Contains(version, "bsdtar"):
+		t.Flavour = TarBSD
+	case strings.Contains(version, "BusyBox"):
+		t.Flavour = TarBusyBox
+	}
+	if t.Flavour != TarUnknown {
+		firstLine, _, _ := strings.Cut(version, "\n")
+		if m := tarVersion.FindStringSubmatch(firstLine); m != nil {
+			t.Version = m[1]
+		}
+	}
+
+	if err := t.probe(); err != nil {
+		return nil, fmt.Errorf("%s can not extract tar archives from stdin: %v", t, err)
+	}
+	return t, nil
+}
+
+// probe extracts a small archive with tar into a temporary directory,
+// the way it is given the archives to extract.
+func (t *TarBinary) probe() error {
+	const probeName = "snapdown-probe"
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: probeName, Mode: 0644, Size: 2, Typeflag: tar.TypeReg})
+	tw.Write([]byte("ok"))
+	tw.Close()
+
+	dir, err := os.MkdirTemp("", "snapdown-probe")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(t.Path, t.extractArgs(dir, nil)...)
+	cmd.Stdin = &archive
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	if !strings.Contains(string(out), probeName) {
+		return fmt.Errorf("unexpected output %q", strings.TrimSpace(string(out)))
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, probeName)); err != nil || string(content) != "ok" {
+		return fmt.Errorf("the archive was not extracted")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package downloader
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestExtractArgs(t *testing.T) {
+	for _, c := range []struct {
+		flavour string
+		extra   []string
+		args    []string
+	}{
+		{TarGNU, nil, []string{"-x", "-v", "-f", "-", "-C", "/dst", "--no-same-owner", "--totals"}},
+		{TarBSD, nil, []string{"-x", "-v", "-f", "-", "-C", "/dst", "--no-same-owner"}},
+		{TarBusyBox, nil, []string{"-x", "-v", "-f", "-", "-C", "/dst", "-o"}},
+		{TarUnknown, nil, []string{"-x", "-v", "-f", "-", "-C", "/dst"}},
+		// Extra arguments come last, so that they can override the others
+		{TarGNU, []string{"--checkpoint=1000"}, []string{"-x", "-v", "-f", "-", "-C", "/dst", "--no-same-owner", "--totals", "--checkpoint=1000"}},
+		{TarUnknown, []string{"-p"}, []string{"-x", "-v", "-f", "-", "-C", "/dst", "-p"}},
+	} {
+		tarBin := &TarBinary{Path: "tar", Flavour: c.flavour}
+		if got := tarBin.extractArgs("/dst", c.extra); !reflect.DeepEqual(got, c.args) {
+			t.Errorf("%s %q: got %q, expected %q", c.flavour, c.extra, got, c.args)
+		}
+	}
+}
+
+func TestDetectTar(t *testing.T) {
+	for _, name := range []string{"tar", "bsdtar"} {
+		if _, err := exec.LookPath(name); err != nil {
+			continue
+		}
+		tarBin, err := DetectTar(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		t.Logf("%s: %s", name, tarBin)
+	}
+	if _, err := DetectTar("snapdown-no-such-tar"); err == nil {
+		t.Error("a tar that does not exist was detected")
+	}
+}
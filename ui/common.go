@@ -2,7 +2,8 @@ package ui
 
 import "fmt"
 
-func bytesHuman(bytes int64) string {
+// BytesHuman formats a byte count using binary units (KB, MB, GB...).
+func BytesHuman(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
 		return fmt.Sprintf("%d B", bytes)
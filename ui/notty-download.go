@@ -27,7 +27,7 @@ func (d *NoTTYDownload) Run() {
 	for update := range d.progressChan {
 		if update.Quit {
 			for s, bytes := range d.shardBytes {
-				log.Printf("[DOWNLOADED] Shard %d - Total bytes in %d (%s)\n", s, bytes, bytesHuman(bytes))
+				log.Printf("[DOWNLOADED] Shard %d - Total bytes in %d (%s)\n", s, bytes, BytesHuman(bytes))
 			}
 			return
 		}
@@ -36,6 +36,10 @@ func (d *NoTTYDownload) Run() {
 			log.Printf("[ERROR] %v\n", update.Error)
 			continue
 		}
+		if update.Warning != "" {
+			log.Printf("[WARN] %s\n", update.Warning)
+			continue
+		}
 		if update.BytesDownloaded == update.BytesTotal {
 			d.shardBytes[update.Shard] += update.BytesTotal
 			log.Printf("[DOWNLOADED] Shard %d - %s (%d bytes)\n", update.Shard, update.ChunkName, update.BytesDownloaded)
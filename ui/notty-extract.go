@@ -34,9 +34,17 @@ func (l *NoTtyExtract) Run() {
 			log.Printf("[ERROR] %v\n", update.Error)
 		case update.Quit:
 			for s, bytes := range l.ShardTotalBytesOut {
-				log.Printf("[WROTE] Shard %d - Total bytes out %d (%s)\n", s, bytes, bytesHuman(bytes))
+				log.Printf("[WROTE] Shard %d - Total bytes out %d (%s)\n", s, bytes, BytesHuman(bytes))
 			}
 			return
+		case update.Done:
+			log.Printf("[DONE] Shard %d\n", update.Shard)
+		case update.Info != "":
+			log.Printf("[INFO] Shard %d: %s\n", update.Shard, update.Info)
+		case update.Warning != "" && update.Shard < 0:
+			log.Printf("[WARN] %s\n", update.Warning)
+		case update.Warning != "":
+			log.Printf("[WARN] Shard %d: %s\n", update.Shard, update.Warning)
 		case update.TotalBytes > 0:
 			l.ShardTotalBytesOut[update.Shard] = update.TotalBytes
 			l.CurrentFile = update.File
@@ -33,6 +33,7 @@ type TtyDownload struct {
 	Progress          progress.Model
 	miniProgress      progress.Model
 	Errors            []error
+	Warnings          []string
 	ActiveChunks      map[string]Chunk
 	MaxJobs           int
 	RecentlyCompleted map[string]time.Time
@@ -117,6 +118,10 @@ func (m TtyDownload) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.Errors = append(m.Errors, msg.Error)
 			return m, waitForUpdates(m.progressChan)
 		}
+		if msg.Warning != "" {
+			m.Warnings = append(m.Warnings, msg.Warning)
+			return m, waitForUpdates(m.progressChan)
+		}
 		chunkId := fmt.Sprintf("%d-%s", msg.Shard, msg.ChunkName)
 		if _, ok := m.RecentlyCompleted[chunkId]; ok {
 			// Already recently completed, safe to ignore further updates
@@ -169,7 +174,7 @@ func (m TtyDownload) View() string {
 			percent = float64(st.DownloadedChunks) / float64(st.TotalChunks)
 		}
 		bar := m.Progress.ViewAs(percent)
-		b.WriteString(fmt.Sprintf("    %04d/%04d %s   %s", st.DownloadedChunks, st.TotalChunks, bar, bytesHuman(st.BytesDownloaded)))
+		b.WriteString(fmt.Sprintf("    %04d/%04d %s   %s", st.DownloadedChunks, st.TotalChunks, bar, BytesHuman(st.BytesDownloaded)))
 
 		// Gather details for active chunks in this shard
 		var details strings.Builder
@@ -194,6 +199,9 @@ func (m TtyDownload) View() string {
 		}
 	}
 
+	for _, w := range m.Warnings {
+		b.WriteString(fmt.Sprintf("[~] %s\n", w))
+	}
 	for _, e := range m.Errors {
 		b.WriteString(fmt.Sprintf("[!] %v\n", e))
 	}
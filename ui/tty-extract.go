@@ -11,8 +11,7 @@ import (
 
 type TtyExtract struct {
 	MaxShard           int
-	CurrentShard       int
-	CurrentFile        string
+	CurrentFiles       map[int]string // file being extracted, per active shard
 	ShardChuncks       map[int]int
 	ShardChunck        map[int]int
 	ShardTotalBytesOut map[int]int64
@@ -20,6 +19,7 @@ type TtyExtract struct {
 	progressBar        progress.Model
 	spinner            spinner.Model
 	Errors             []error
+	Warnings           []string
 }
 
 func NewTtyExtract(maxShard int, updates <-chan downloader.XUpdMsg) TtyExtract {
@@ -32,7 +32,7 @@ func NewTtyExtract(maxShard int, updates <-chan downloader.XUpdMsg) TtyExtract {
 	spin.Spinner = spinner.Dot
 	return TtyExtract{
 		MaxShard:           maxShard,
-		CurrentShard:       0,
+		CurrentFiles:       make(map[int]string, maxShard+1),
 		updatesCh:          updates,
 		ShardChuncks:       make(map[int]int, maxShard+1),
 		ShardChunck:        make(map[int]int, maxShard+1),
@@ -71,14 +71,22 @@ func (m TtyExtract) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			//return m, tea.Quit
 		}
 		if msg.Quit {
-			m.CurrentFile = ""
+			clear(m.CurrentFiles)
 			return m, tea.Quit
 		}
-		if msg.TotalBytes > 0 {
+		switch {
+		case msg.Done:
+			delete(m.CurrentFiles, msg.Shard)
+		case msg.Info != "":
+			m.CurrentFiles[msg.Shard] = msg.Info
+		case msg.Warning != "" && msg.Shard < 0:
+			m.Warnings = append(m.Warnings, msg.Warning)
+		case msg.Warning != "":
+			m.Warnings = append(m.Warnings, fmt.Sprintf("Shard %d: %s", msg.Shard, msg.Warning))
+		case msg.TotalBytes > 0:
 			m.ShardTotalBytesOut[msg.Shard] = msg.TotalBytes
-			m.CurrentFile = msg.File
-		} else {
-			m.CurrentShard = msg.Shard
+			m.CurrentFiles[msg.Shard] = msg.File
+		case msg.Error == nil:
 			m.ShardChuncks[msg.Shard] = msg.Total
 			m.ShardChunck[msg.Shard] = msg.Idx
 		}
@@ -107,10 +115,22 @@ func (m TtyExtract) View() string {
 		}
 
 		bar := m.progressBar.ViewAs(percent)
-		s += fmt.Sprintf("    %04d/%04d %s   %s\n", currentChunk, totalChunks, bar, bytesHuman(totalBytes))
+		s += fmt.Sprintf("    %04d/%04d %s   %s\n", currentChunk, totalChunks, bar, BytesHuman(totalBytes))
 	}
-	if m.CurrentFile != "" {
-		s += fmt.Sprintf("\n%sExtracting %s\n\n", m.spinner.View(), m.CurrentFile)
+	if len(m.CurrentFiles) > 0 {
+		s += "\n"
+		for i := 0; i <= m.MaxShard; i++ {
+			if file, ok := m.CurrentFiles[i]; ok {
+				s += fmt.Sprintf("%sExtracting %s\n", m.spinner.View(), file)
+			}
+		}
+		s += "\n"
+	}
+	if len(m.Warnings) > 0 {
+		s += "\n"
+		for _, w := range m.Warnings {
+			s += fmt.Sprintf("[~] %s\n", w)
+		}
 	}
 	if len(m.Errors) > 0 {
 		s += "\n"